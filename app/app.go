@@ -1,10 +1,13 @@
 package app
 
 import (
+	"log"
+
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"github.com/xorgal/xtun-client/app/content"
 	"github.com/xorgal/xtun-client/internal"
+	"github.com/xorgal/xtun-core/pkg/config"
 )
 
 func RunLoop() {
@@ -21,6 +24,12 @@ func RunLoop() {
 		currentScreen = content.BuildSetupScreen(w)
 	}
 
+	// Keep endpoint latency up to date for auto selection
+	go internal.RunIdleProber()
+
+	// Keep provisioned profiles up to date
+	go internal.RunProvisioner()
+
 	// Setup app in system's tray
 	SetSystemTray(a, w)
 
@@ -35,4 +44,14 @@ func RunLoop() {
 
 	// Start RunLoop
 	w.ShowAndRun()
+
+	// Undo the kill switch, routes and DNS of the main tunnel
+	if internal.IsClientActive() {
+		if err := internal.StopClient(config.AppConfig); err != nil {
+			log.Print(err)
+		}
+	}
+
+	// Profiles connected alongside the main tunnel
+	internal.StopTunnels()
 }
@@ -0,0 +1,109 @@
+package content
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+type DNSScreen struct {
+	entries    []internal.QueryLogEntry
+	statsLabel *widget.Label
+	list       *widget.List
+}
+
+func BuildDNSScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
+	var s DNSScreen
+
+	forwarderCheck := widget.NewCheck("", nil)
+	forwarderCheck.SetChecked(internal.ClientOptions.DNSForwarder)
+
+	addrEntry := widget.NewEntry()
+	addrEntry.SetText(internal.ClientOptions.ResolverAddr)
+
+	upstreamsEntry := widget.NewMultiLineEntry()
+	upstreamsEntry.SetPlaceHolder("Server DNS")
+	upstreamsEntry.SetText(strings.Join(internal.ClientOptions.ResolverUpstreams, "\n"))
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{
+				Text:     "Forward all DNS",
+				Widget:   forwarderCheck,
+				HintText: "Applies on next connect",
+			},
+			{
+				Text:   "Listen on",
+				Widget: addrEntry,
+			},
+			{
+				Text:     "Upstreams",
+				Widget:   upstreamsEntry,
+				HintText: "IP, tcp://IP:port or https:// (DoH), one per line",
+			},
+		},
+		OnSubmit: func() {
+			if reloadIfProvisioned(w, BuildDNSScreen) {
+				return
+			}
+			upstreams := splitLines(upstreamsEntry.Text)
+			if err := internal.CheckUpstreams(upstreams); err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			internal.ClientOptions.DNSForwarder = forwarderCheck.Checked
+			internal.ClientOptions.ResolverAddr = addrEntry.Text
+			internal.ClientOptions.ResolverUpstreams = upstreams
+			internal.SaveOptionsFile(internal.ClientOptions)
+			log.Println("DNS configuration saved")
+		},
+		SubmitText: "Save",
+	}
+
+	s.statsLabel = widget.NewLabel("")
+	refreshBtn := widget.NewButton("Refresh", s.refresh)
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.entries)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(formatQuery(s.entries[id]))
+		},
+	)
+	s.refresh()
+
+	top := container.NewVBox(form, container.NewBorder(nil, nil, nil, refreshBtn, s.statsLabel))
+	return container.NewBorder(top, nil, nil, nil, s.list)
+}
+
+func (s *DNSScreen) refresh() {
+	stats := internal.GetResolverStats()
+	s.statsLabel.SetText(fmt.Sprintf("%d queries, %.0f%% from cache, %d failed",
+		stats.Queries, stats.HitRate()*100, stats.Errors))
+	s.entries = internal.GetQueryLog()
+	s.list.Refresh()
+}
+
+func formatQuery(e internal.QueryLogEntry) string {
+	result := e.Upstream
+	if e.Cached {
+		result = "cache"
+	}
+	if e.Err != nil {
+		result = e.Err.Error()
+	}
+	return fmt.Sprintf("%s  %s %s  %s, %v", e.Time.Format("15:04:05"), e.Type, e.Name,
+		result, e.Duration.Round(time.Millisecond))
+}
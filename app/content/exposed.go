@@ -0,0 +1,94 @@
+package content
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+type ExposedScreen struct {
+	conns []internal.InboundConn
+	list  *widget.List
+}
+
+func BuildExposedScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
+	var s ExposedScreen
+
+	forwardsEntry := widget.NewMultiLineEntry()
+	forwardsEntry.SetPlaceHolder("8080 3000")
+	forwardsEntry.SetText(internal.FormatReverseForwards(internal.ClientOptions.ReverseForwards))
+
+	peersEntry := widget.NewMultiLineEntry()
+	peersEntry.SetPlaceHolder("10.8.0.5\n10.8.0.0/24")
+	peersEntry.SetText(strings.Join(internal.ClientOptions.ReverseForwardPeers, "\n"))
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{
+				Text:     "Services",
+				Widget:   forwardsEntry,
+				HintText: "tunnel port and local port, applies on next connect",
+			},
+			{
+				Text:     "Allowed peers",
+				Widget:   peersEntry,
+				HintText: "Addresses or prefixes, nobody if empty",
+			},
+		},
+		OnSubmit: func() {
+			if reloadIfProvisioned(w, BuildExposedScreen) {
+				return
+			}
+			forwards, err := internal.ParseReverseForwards(forwardsEntry.Text)
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			peers := splitLines(peersEntry.Text)
+			if _, err := internal.ParsePeers(peers); err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			internal.ClientOptions.ReverseForwards = forwards
+			internal.ClientOptions.ReverseForwardPeers = peers
+			internal.SaveOptionsFile(internal.ClientOptions)
+			log.Println("Exposed services saved")
+		},
+		SubmitText: "Save",
+	}
+
+	refreshBtn := widget.NewButton("Refresh", s.refresh)
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.conns)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(formatInboundConn(s.conns[id]))
+		},
+	)
+	s.refresh()
+
+	return container.NewBorder(container.NewVBox(form, refreshBtn), nil, nil, nil, s.list)
+}
+
+func (s *ExposedScreen) refresh() {
+	s.conns = internal.GetInboundConns()
+	s.list.Refresh()
+}
+
+func formatInboundConn(c internal.InboundConn) string {
+	return fmt.Sprintf("%s -> %s, %s, sent %s, received %s", c.Peer, c.Forward.Local,
+		time.Since(c.Since).Round(time.Second), formatBytes(uint64(c.Sent)), formatBytes(uint64(c.Received)))
+}
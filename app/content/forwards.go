@@ -0,0 +1,84 @@
+package content
+
+import (
+	"fmt"
+	"log"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+type ForwardsScreen struct {
+	stats []internal.ForwardStats
+	list  *widget.List
+}
+
+func BuildForwardsScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
+	var s ForwardsScreen
+
+	forwardsEntry := widget.NewMultiLineEntry()
+	forwardsEntry.SetPlaceHolder("5432 10.8.0.5:5432\n127.0.0.1:5353 10.8.0.1:53 udp")
+	forwardsEntry.SetText(internal.FormatForwards(internal.ClientOptions.Forwards))
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{
+				Text:     "Forwards",
+				Widget:   forwardsEntry,
+				HintText: "local remote [tcp|udp], applies on next connect",
+			},
+		},
+		OnSubmit: func() {
+			if reloadIfProvisioned(w, BuildForwardsScreen) {
+				return
+			}
+			forwards, err := internal.ParseForwards(forwardsEntry.Text)
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			internal.ClientOptions.Forwards = forwards
+			internal.SaveOptionsFile(internal.ClientOptions)
+			log.Println("Forwards saved")
+		},
+		SubmitText: "Save",
+	}
+
+	refreshBtn := widget.NewButton("Refresh", s.refresh)
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.stats)
+		},
+		func() fyne.CanvasObject {
+			name := widget.NewLabel("")
+			name.TextStyle = fyne.TextStyle{Bold: true}
+			return container.NewVBox(name, widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			c := o.(*fyne.Container)
+			c.Objects[0].(*widget.Label).SetText(s.stats[id].Forward.String())
+			c.Objects[1].(*widget.Label).SetText(formatForwardStats(s.stats[id]))
+		},
+	)
+	s.refresh()
+
+	return container.NewBorder(container.NewVBox(form, refreshBtn), nil, nil, nil, s.list)
+}
+
+func (s *ForwardsScreen) refresh() {
+	s.stats = internal.GetForwardStats()
+	s.list.Refresh()
+}
+
+func formatForwardStats(stats internal.ForwardStats) string {
+	if stats.Err != nil {
+		return stats.Err.Error()
+	}
+	return fmt.Sprintf("%d active, %d total, sent %s, received %s", stats.Active, stats.Total,
+		formatBytes(uint64(stats.Sent)), formatBytes(uint64(stats.Received)))
+}
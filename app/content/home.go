@@ -23,12 +23,15 @@ type HomeScreen struct {
 	statsForm       *widget.Form
 	serverIPLabel   *widget.Label
 	clientIPLabel   *widget.Label
+	serverIPv6Label *widget.Label
+	clientIPv6Label *widget.Label
 	bufferSizeLabel *widget.Label
 	mtuLabel        *widget.Label
 	compressLabel   *widget.Label
 	readBytes       *widget.Label
 	writeBytes      *widget.Label
-	errCh           chan<- error
+	errLabel        *widget.Label
+	errCh           chan error
 	container       *fyne.Container
 }
 
@@ -37,7 +40,7 @@ func BuildHomeScreen(w fyne.Window) *fyne.Container {
 
 	s.w = w
 
-	s.addrLabel = widget.NewLabel(config.AppConfig.ServerAddr)
+	s.addrLabel = widget.NewLabel(getServerAddr())
 	s.addrLabel.Alignment = fyne.TextAlignCenter
 	s.addrLabel.TextStyle = fyne.TextStyle{Bold: true}
 
@@ -45,8 +48,13 @@ func BuildHomeScreen(w fyne.Window) *fyne.Container {
 
 	s.serverIPLabel = widget.NewLabel(config.AppConfig.ServerIP)
 	s.clientIPLabel = widget.NewLabel(strings.Split(config.AppConfig.CIDR, "/")[0])
+	s.serverIPv6Label = widget.NewLabel(internal.ClientOptions.ServerIPv6)
+	s.clientIPv6Label = widget.NewLabel(strings.Split(internal.ClientOptions.CIDRv6, "/")[0])
 	s.bufferSizeLabel = widget.NewLabel(strconv.Itoa(config.AppConfig.BufferSize))
 	s.mtuLabel = widget.NewLabel(strconv.Itoa(config.AppConfig.MTU))
+	if internal.ClientOptions.TapMode {
+		s.mtuLabel.SetText(fmt.Sprintf("%d (TAP %d)", config.AppConfig.MTU, internal.TapMTU(config.AppConfig.MTU)))
+	}
 	s.compressLabel = widget.NewLabel(strconv.FormatBool(config.AppConfig.Compress))
 	s.readBytes = widget.NewLabel("")
 	s.writeBytes = widget.NewLabel("")
@@ -55,17 +63,26 @@ func BuildHomeScreen(w fyne.Window) *fyne.Container {
 	s.statsForm = widget.NewForm(
 		widget.NewFormItem("Server IP", s.serverIPLabel),
 		widget.NewFormItem("Client IP", s.clientIPLabel),
-		widget.NewFormItem("Buffer Size", s.bufferSizeLabel),
-		widget.NewFormItem("MTU", s.mtuLabel),
-		widget.NewFormItem("Use Compression", s.compressLabel),
-		widget.NewFormItem("Read Bytes", s.readBytes),
-		widget.NewFormItem("Written Bytes", s.writeBytes),
 	)
+	if internal.ClientOptions.CIDRv6 != "" {
+		s.statsForm.Append("Server IPv6", s.serverIPv6Label)
+		s.statsForm.Append("Client IPv6", s.clientIPv6Label)
+	}
+	s.statsForm.AppendItem(widget.NewFormItem("Buffer Size", s.bufferSizeLabel))
+	s.statsForm.AppendItem(widget.NewFormItem("MTU", s.mtuLabel))
+	s.statsForm.AppendItem(widget.NewFormItem("Use Compression", s.compressLabel))
+	s.statsForm.AppendItem(widget.NewFormItem("Read Bytes", s.readBytes))
+	s.statsForm.AppendItem(widget.NewFormItem("Written Bytes", s.writeBytes))
 	s.statsForm.Hide()
 
-	s.errCh = make(chan<- error)
+	s.errLabel = widget.NewLabel("")
+	s.errLabel.Alignment = fyne.TextAlignCenter
+	s.errLabel.Wrapping = fyne.TextWrapWord
+	s.errLabel.Hide()
+	s.errCh = make(chan error, 1)
+	go s.showErrors()
 
-	s.container = container.NewVBox(s.addrLabel, s.ctrlBtn, s.statsForm)
+	s.container = container.NewVBox(s.addrLabel, s.ctrlBtn, s.errLabel, s.statsForm)
 
 	state := getConnectionStateNotifier()
 
@@ -76,6 +93,8 @@ func BuildHomeScreen(w fyne.Window) *fyne.Container {
 
 func (s *HomeScreen) updateScreen(state chan internal.ConnectionState) {
 	for state := range state {
+		s.addrLabel.SetText(getServerAddr())
+
 		switch state {
 		case internal.Disconnected:
 			s.ctrlBtn.Text = "Connect"
@@ -86,6 +105,7 @@ func (s *HomeScreen) updateScreen(state chan internal.ConnectionState) {
 			s.ctrlBtn.Text = "Disconnect"
 			s.ctrlBtn.OnTapped = s.disconnect
 			s.ctrlBtn.Enable()
+			s.errLabel.Hide()
 			s.statsForm.Show() // Show stats when connected
 			// Update read and write labels
 			s.readBytes.SetText(formatBytes(counter.GetReadBytes()))
@@ -104,6 +124,14 @@ func (s *HomeScreen) updateScreen(state chan internal.ConnectionState) {
 	}
 }
 
+// showErrors shows the last error of the client until it connects.
+func (s *HomeScreen) showErrors() {
+	for err := range s.errCh {
+		s.errLabel.SetText(err.Error())
+		s.errLabel.Show()
+	}
+}
+
 func (s *HomeScreen) buildCtrlBtn() *widget.Button {
 	var label string
 	var action func()
@@ -122,6 +150,15 @@ func (s *HomeScreen) buildCtrlBtn() *widget.Button {
 }
 
 func (s *HomeScreen) connect() {
+	internal.ApplyProvisionedProfile()
+	if err := internal.PrepareTapMAC(); err != nil {
+		lib.ShowErrorDialog(s.w, err)
+		return
+	}
+	if err := internal.CheckMainConflicts(config.AppConfig, internal.ClientOptions); err != nil {
+		lib.ShowErrorDialog(s.w, err)
+		return
+	}
 	go internal.StartClient(config.AppConfig, s.errCh)
 }
 
@@ -133,6 +170,15 @@ func (s *HomeScreen) disconnect() {
 	}
 }
 
+// getServerAddr returns the endpoint in use by the client, or the
+// configured primary server when the client is stopped.
+func getServerAddr() string {
+	if addr := internal.GetActiveEndpoint(); addr != "" {
+		return addr
+	}
+	return config.AppConfig.ServerAddr
+}
+
 func getConnectionStateNotifier() chan internal.ConnectionState {
 	state := make(chan internal.ConnectionState)
 
@@ -0,0 +1,184 @@
+package content
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+type ProfilesScreen struct {
+	w        fyne.Window
+	profiles []string
+	list     *widget.List
+}
+
+func BuildProfilesScreen(w fyne.Window) fyne.CanvasObject {
+	s := &ProfilesScreen{w: w}
+
+	nameEntry := widget.NewEntry()
+	serverEntry := widget.NewEntry()
+	serverEntry.SetPlaceHolder("host:port")
+	keyEntry := widget.NewPasswordEntry()
+	deviceEntry := widget.NewEntry()
+	deviceEntry.SetPlaceHolder("xtun1")
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Profile name", Widget: nameEntry},
+			{Text: "Server address", Widget: serverEntry},
+			{Text: "Key", Widget: keyEntry},
+			{
+				Text:     "Device name",
+				Widget:   deviceEntry,
+				HintText: "Must differ between tunnels connected at the same time",
+			},
+		},
+		OnSubmit: func() {
+			name := strings.TrimSpace(nameEntry.Text)
+			err := internal.NewProfile(name, serverEntry.Text, keyEntry.Text, deviceEntry.Text)
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			log.Printf("Profile %s created", name)
+			nameEntry.SetText("")
+			serverEntry.SetText("")
+			keyEntry.SetText("")
+			deviceEntry.SetText("")
+			s.refresh()
+		},
+		SubmitText: "Create",
+	}
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.profiles)
+		},
+		func() fyne.CanvasObject {
+			name := widget.NewLabel("")
+			name.TextStyle = fyne.TextStyle{Bold: true}
+			buttons := container.NewHBox(
+				widget.NewButton("Set default", nil),
+				widget.NewButton("Clone", nil),
+				widget.NewButton("Rename", nil),
+				widget.NewButton("Delete", nil),
+			)
+			return container.NewBorder(nil, nil, nil, buttons, container.NewVBox(name, widget.NewLabel("")))
+		},
+		s.updateItem,
+	)
+	s.refresh()
+
+	imported := func(string) {
+		s.refresh()
+	}
+	importBox := container.NewVBox(
+		buildImportLinkForm(w, imported),
+		widget.NewButton("Import file...", func() {
+			importProfileFile(w, imported)
+		}),
+	)
+
+	return container.NewBorder(container.NewVBox(form, widget.NewSeparator(), importBox), nil, nil, nil, s.list)
+}
+
+func (s *ProfilesScreen) refresh() {
+	profiles, err := internal.ListProfiles()
+	if err != nil {
+		log.Print(err)
+	}
+	s.profiles = profiles
+	s.list.Refresh()
+}
+
+func (s *ProfilesScreen) updateItem(id widget.ListItemID, o fyne.CanvasObject) {
+	name := s.profiles[id]
+	c := o.(*fyne.Container)
+	labels := c.Objects[0].(*fyne.Container)
+	buttons := c.Objects[1].(*fyne.Container)
+
+	title := name
+	if name == internal.GetDefaultProfile() {
+		title += " (default)"
+	}
+	labels.Objects[0].(*widget.Label).SetText(title)
+	labels.Objects[1].(*widget.Label).SetText(describeProfile(name))
+
+	defaultBtn := buttons.Objects[0].(*widget.Button)
+	defaultBtn.OnTapped = func() {
+		if err := internal.SetDefaultProfile(name); err != nil {
+			lib.ShowErrorDialog(s.w, err)
+			return
+		}
+		s.refresh()
+	}
+	if name == internal.GetDefaultProfile() {
+		defaultBtn.Disable()
+	} else {
+		defaultBtn.Enable()
+	}
+	buttons.Objects[1].(*widget.Button).OnTapped = func() {
+		s.askName("Clone profile", name+"-copy", func(newName string) error {
+			return internal.CloneProfile(name, newName)
+		})
+	}
+	buttons.Objects[2].(*widget.Button).OnTapped = func() {
+		s.askName("Rename profile", name, func(newName string) error {
+			return internal.RenameProfile(name, newName)
+		})
+	}
+	buttons.Objects[3].(*widget.Button).OnTapped = func() {
+		dialog.ShowConfirm("Delete profile", fmt.Sprintf("Delete profile %s?", name), func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := internal.DeleteProfile(name); err != nil {
+				lib.ShowErrorDialog(s.w, err)
+			}
+			s.refresh()
+		}, s.w)
+	}
+	buttons.Objects[4].(*widget.Button).OnTapped = func() {
+		showExportDialog(s.w, name)
+	}
+}
+
+// askName asks for a profile name and passes it to apply.
+func (s *ProfilesScreen) askName(title string, initial string, apply func(string) error) {
+	entry := widget.NewEntry()
+	entry.SetText(initial)
+	items := []*widget.FormItem{{Text: "Name", Widget: entry}}
+	dialog.ShowForm(title, "OK", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		if err := apply(strings.TrimSpace(entry.Text)); err != nil {
+			lib.ShowErrorDialog(s.w, err)
+		}
+		s.refresh()
+	}, s.w)
+}
+
+func describeProfile(name string) string {
+	var c config.Config
+	var options internal.IClientOptions
+	var err error
+	if name == internal.GetMainProfile() {
+		c, options = config.AppConfig, internal.ClientOptions
+	} else if c, options, err = internal.LoadProfile(name); err != nil {
+		return err.Error()
+	}
+	text := fmt.Sprintf("%s, device %s", c.ServerAddr, c.DeviceName)
+	if options.ProvisioningURL != "" {
+		text += fmt.Sprintf(", provisioned (serial %d)", options.ProvisioningSerial)
+	}
+	return text
+}
@@ -0,0 +1,20 @@
+package content
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+// reloadIfProvisioned applies an update of the profile provisioned while
+// a settings screen was open. The values of the screen are stale then and
+// saving them would roll the profile back, so the screen is built again
+// instead. It reports whether the save must be dropped.
+func reloadIfProvisioned(w fyne.Window, build func(fyne.Window) fyne.CanvasObject) bool {
+	if !internal.ApplyProvisionedProfile() {
+		return false
+	}
+	w.SetContent(build(w))
+	dialog.ShowInformation("Profile updated", "The profile was provisioned while you were editing it. Review the settings and save again.", w)
+	return true
+}
@@ -0,0 +1,238 @@
+package content
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+const routesUnsupportedHint = "Not supported on this platform"
+
+func BuildRoutingScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
+	includeEntry := widget.NewMultiLineEntry()
+	includeEntry.SetPlaceHolder("All traffic")
+	includeEntry.SetText(strings.Join(internal.ClientOptions.IncludeRoutes, "\n"))
+
+	excludeEntry := widget.NewMultiLineEntry()
+	excludeEntry.SetPlaceHolder("None")
+	excludeEntry.SetText(strings.Join(internal.ClientOptions.ExcludeRoutes, "\n"))
+
+	domainsEntry := widget.NewMultiLineEntry()
+	domainsEntry.SetPlaceHolder("internal.corp\n*.git.example")
+	domainsEntry.SetText(strings.Join(internal.ClientOptions.DomainRoutes, "\n"))
+
+	acceptCheck := widget.NewCheck("", nil)
+	acceptCheck.SetChecked(internal.ClientOptions.AcceptServerRoutes)
+
+	policyCheck := widget.NewCheck("", nil)
+	policyCheck.SetChecked(internal.ClientOptions.PolicyRouting)
+
+	blockIPv6Check := widget.NewCheck("", nil)
+	blockIPv6Check.SetChecked(internal.ClientOptions.BlockIPv6)
+
+	killSwitchCheck := widget.NewCheck("", nil)
+	killSwitchCheck.SetChecked(internal.ClientOptions.KillSwitch)
+
+	allowLANCheck := widget.NewCheck("", nil)
+	allowLANCheck.SetChecked(internal.ClientOptions.KillSwitchAllowLAN)
+
+	applyDNSCheck := widget.NewCheck("", nil)
+	applyDNSCheck.SetChecked(internal.ClientOptions.ApplyDNS)
+
+	blockDNSCheck := widget.NewCheck("", nil)
+	blockDNSCheck.SetChecked(internal.ClientOptions.BlockOffTunnelDNS)
+
+	userspaceCheck := widget.NewCheck("", nil)
+	userspaceCheck.SetChecked(internal.ClientOptions.UserspaceStack)
+	userspaceHint := "No tun interface or root, use the proxies"
+	if !internal.UserStackAvailable {
+		userspaceHint = "Not available in this build"
+		if !userspaceCheck.Checked {
+			userspaceCheck.Disable()
+		}
+	}
+
+	// Options that are set stay enabled so that they can be turned off
+	cidrHint, policyHint, blockIPv6Hint, domainsHint := "One CIDR per line", "Dedicated routing table (Linux)",
+		"When the server is IPv4 only", "Routed via the local resolver"
+	if !internal.RoutesSupported() {
+		cidrHint, policyHint, blockIPv6Hint, domainsHint = routesUnsupportedHint, routesUnsupportedHint,
+			routesUnsupportedHint, routesUnsupportedHint
+		for _, entry := range []*widget.Entry{includeEntry, excludeEntry, domainsEntry} {
+			if entry.Text == "" {
+				entry.Disable()
+			}
+		}
+		for _, check := range []*widget.Check{policyCheck, blockIPv6Check} {
+			if !check.Checked {
+				check.Disable()
+			}
+		}
+	}
+
+	socksEntry := widget.NewEntry()
+	socksEntry.SetPlaceHolder("Disabled")
+	socksEntry.SetText(internal.ClientOptions.SOCKSAddr)
+
+	httpProxyEntry := widget.NewEntry()
+	httpProxyEntry.SetPlaceHolder("Disabled")
+	httpProxyEntry.SetText(internal.ClientOptions.HTTPProxyAddr)
+
+	// options returns a copy of the client options with the edited lists
+	options := func() internal.IClientOptions {
+		options := internal.ClientOptions
+		options.IncludeRoutes = splitLines(includeEntry.Text)
+		options.ExcludeRoutes = splitLines(excludeEntry.Text)
+		options.DomainRoutes = splitLines(domainsEntry.Text)
+		options.AcceptServerRoutes = acceptCheck.Checked
+		options.PolicyRouting = policyCheck.Checked
+		options.BlockIPv6 = blockIPv6Check.Checked
+		options.KillSwitch = killSwitchCheck.Checked
+		options.KillSwitchAllowLAN = allowLANCheck.Checked
+		options.ApplyDNS = applyDNSCheck.Checked
+		options.BlockOffTunnelDNS = blockDNSCheck.Checked
+		options.UserspaceStack = userspaceCheck.Checked
+		options.SOCKSAddr = strings.TrimSpace(socksEntry.Text)
+		options.HTTPProxyAddr = strings.TrimSpace(httpProxyEntry.Text)
+		return options
+	}
+
+	previewBtn := widget.NewButton("Preview routes", func() {
+		routes, err := internal.PlanRoutes(internal.MergeRoutes(options()), config.AppConfig.DeviceName, config.AppConfig.LocalGateway)
+		if err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		dialog.NewInformation("Routes", formatRoutes(internal.MergeRoutes(options()), routes), w).Show()
+	})
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{
+				Text:     "Include",
+				Widget:   includeEntry,
+				HintText: cidrHint,
+			},
+			{
+				Text:     "Exclude",
+				Widget:   excludeEntry,
+				HintText: cidrHint,
+			},
+			{
+				Text:     "Server routes",
+				Widget:   acceptCheck,
+				HintText: "Local rules take precedence",
+			},
+			{
+				Text:     "Policy routing",
+				Widget:   policyCheck,
+				HintText: policyHint,
+			},
+			{
+				Text:     "Block IPv6",
+				Widget:   blockIPv6Check,
+				HintText: blockIPv6Hint,
+			},
+			{
+				Text:     "Kill switch",
+				Widget:   killSwitchCheck,
+				HintText: "Block traffic outside the tunnel (Linux)",
+			},
+			{
+				Text:   "Allow LAN",
+				Widget: allowLANCheck,
+			},
+			{
+				Text:     "Server DNS",
+				Widget:   applyDNSCheck,
+				HintText: "Use the DNS servers pushed by the server",
+			},
+			{
+				Text:     "Block other DNS",
+				Widget:   blockDNSCheck,
+				HintText: "Drop port 53 outside the tunnel (Linux)",
+			},
+			{
+				Text:     "Domains",
+				Widget:   domainsEntry,
+				HintText: domainsHint,
+			},
+			{
+				Text:     "Userspace mode",
+				Widget:   userspaceCheck,
+				HintText: userspaceHint,
+			},
+			{
+				Text:     "SOCKS5 proxy",
+				Widget:   socksEntry,
+				HintText: "Loopback address, e.g. 127.0.0.1:1080",
+			},
+			{
+				Text:     "HTTP proxy",
+				Widget:   httpProxyEntry,
+				HintText: "Loopback address, e.g. 127.0.0.1:8080",
+			},
+		},
+		OnSubmit: func() {
+			if reloadIfProvisioned(w, BuildRoutingScreen) {
+				return
+			}
+			options := options()
+			for _, addr := range []string{options.SOCKSAddr, options.HTTPProxyAddr} {
+				if err := internal.CheckProxyAddr(addr); err != nil {
+					lib.ShowErrorDialog(w, err)
+					return
+				}
+			}
+			if _, err := internal.PlanRoutes(internal.MergeRoutes(options), config.AppConfig.DeviceName, config.AppConfig.LocalGateway); err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			internal.ClientOptions = options
+			internal.SaveOptionsFile(internal.ClientOptions)
+			log.Println("Routing configuration saved")
+		},
+		OnCancel: func() {
+			w.SetContent(BuildHomeScreen(w))
+		},
+		SubmitText: "Save",
+		CancelText: "Cancel",
+	}
+
+	return container.NewVScroll(container.NewVBox(form, previewBtn))
+}
+
+func formatRoutes(options internal.IClientOptions, routes []internal.Route) string {
+	lines := []string{}
+	if internal.IsSplitTunnel(options) {
+		lines = append(lines, "Split tunnel:")
+	} else {
+		lines = append(lines, "Full tunnel (default route via tunnel)")
+	}
+	for _, r := range routes {
+		lines = append(lines, r.String())
+	}
+	for _, d := range options.DomainRoutes {
+		lines = append(lines, fmt.Sprintf("%s (resolved via %s)", d, options.ResolverAddr))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func splitLines(text string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,121 @@
+package content
+
+import (
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/internal"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+type ServersScreen struct {
+	w         fyne.Window
+	endpoints []internal.Endpoint
+	results   map[string]internal.ProbeResult
+	autoCheck *widget.Check
+	probeBtn  *widget.Button
+	list      *widget.List
+}
+
+func BuildServersScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
+	var s ServersScreen
+
+	s.w = w
+	s.endpoints = internal.GetEndpoints(config.AppConfig, internal.ClientOptions)
+	s.loadResults()
+
+	s.autoCheck = widget.NewCheck("", func(checked bool) {
+		if reloadIfProvisioned(w, BuildServersScreen) {
+			return
+		}
+		internal.ClientOptions.AutoSelect = checked
+		internal.SaveOptionsFile(internal.ClientOptions)
+	})
+	s.autoCheck.SetChecked(internal.ClientOptions.AutoSelect)
+
+	s.probeBtn = widget.NewButton("Probe now", s.probe)
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.endpoints)
+		},
+		func() fyne.CanvasObject {
+			addr := widget.NewLabel("")
+			addr.TextStyle = fyne.TextStyle{Bold: true}
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Pin", nil),
+				container.NewVBox(addr, widget.NewLabel("")))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			s.updateItem(s.endpoints[id], o.(*fyne.Container))
+		},
+	)
+
+	form := widget.NewForm(
+		widget.NewFormItem("Auto-select", s.autoCheck),
+	)
+
+	return container.NewBorder(container.NewVBox(form, s.probeBtn), nil, nil, nil, s.list)
+}
+
+func (s *ServersScreen) updateItem(e internal.Endpoint, c *fyne.Container) {
+	info := c.Objects[0].(*fyne.Container)
+	pinBtn := c.Objects[1].(*widget.Button)
+
+	info.Objects[0].(*widget.Label).SetText(e.Addr)
+	info.Objects[1].(*widget.Label).SetText(s.formatResult(e.Addr))
+
+	if internal.ClientOptions.PinnedEndpoint == e.Addr {
+		pinBtn.SetText("Unpin")
+	} else {
+		pinBtn.SetText("Pin")
+	}
+	pinBtn.OnTapped = func() {
+		if reloadIfProvisioned(s.w, BuildServersScreen) {
+			return
+		}
+		if internal.ClientOptions.PinnedEndpoint == e.Addr {
+			internal.ClientOptions.PinnedEndpoint = ""
+		} else {
+			internal.ClientOptions.PinnedEndpoint = e.Addr
+		}
+		internal.SaveOptionsFile(internal.ClientOptions)
+		s.list.Refresh()
+	}
+}
+
+func (s *ServersScreen) formatResult(addr string) string {
+	r, ok := s.results[addr]
+	if !ok {
+		return "Not probed"
+	}
+	if r.Err != nil {
+		return "Unreachable"
+	}
+	text := fmt.Sprintf("TCP %v, TLS %v",
+		r.Connect.Round(time.Millisecond), r.TLSHandshake.Round(time.Millisecond))
+	if r.PingRTT > 0 {
+		text += fmt.Sprintf(", RTT %v", r.PingRTT.Round(time.Millisecond))
+	}
+	return text
+}
+
+func (s *ServersScreen) loadResults() {
+	s.results = map[string]internal.ProbeResult{}
+	for _, r := range internal.GetProbeResults() {
+		s.results[r.Addr] = r
+	}
+}
+
+func (s *ServersScreen) probe() {
+	s.probeBtn.Disable()
+	go func() {
+		internal.ProbeEndpoints(config.AppConfig, s.endpoints)
+		s.loadResults()
+		s.list.Refresh()
+		s.probeBtn.Enable()
+	}()
+}
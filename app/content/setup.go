@@ -14,6 +14,7 @@ import (
 )
 
 func BuildSetupScreen(w fyne.Window) fyne.CanvasObject {
+	internal.ApplyProvisionedProfile()
 	separator := widget.NewSeparator()
 	box := container.NewVBox(widget.NewForm(), separator, widget.NewForm())
 
@@ -48,7 +49,17 @@ func BuildSetupScreen(w fyne.Window) fyne.CanvasObject {
 	setupForm := createSetupForm(w)
 	(*box).Objects[2] = setupForm
 
-	return box
+	importForm := buildImportLinkForm(w, func(name string) {
+		if err := internal.SetDefaultProfile(name); err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		internal.AppState.IsInitialized = true
+		internal.SaveStateFile(internal.AppState)
+		w.SetContent(BuildHomeScreen(w))
+	})
+
+	return container.NewVBox(importForm, widget.NewSeparator(), box)
 }
 
 func createSetupForm(w fyne.Window) *widget.Form {
@@ -58,6 +69,13 @@ func createSetupForm(w fyne.Window) *widget.Form {
 	keyEntry := widget.NewPasswordEntry()
 	keyEntry.SetText(config.AppConfig.Key)
 
+	endpointsEntry := widget.NewMultiLineEntry()
+	endpointsEntry.SetPlaceHolder("host:port [priority [weight]]")
+	endpointsEntry.SetText(internal.FormatEndpoints(internal.ClientOptions.Endpoints))
+
+	streamCountEntry := lib.NewNumericalEntry()
+	streamCountEntry.SetText(strconv.Itoa(internal.ClientOptions.StreamCount))
+
 	deviceNameEntry := widget.NewEntry()
 	deviceNameEntry.SetText(config.AppConfig.DeviceName)
 
@@ -70,6 +88,9 @@ func createSetupForm(w fyne.Window) *widget.Form {
 	compressEntry := widget.NewCheck("", nil)
 	compressEntry.SetChecked(config.AppConfig.Compress)
 
+	tapModeCheck := widget.NewCheck("", nil)
+	tapModeCheck.SetChecked(internal.ClientOptions.TapMode)
+
 	formItems := []*widget.FormItem{
 		{
 			Text:   "Server address",
@@ -79,6 +100,19 @@ func createSetupForm(w fyne.Window) *widget.Form {
 			Text:   "Key",
 			Widget: keyEntry,
 		},
+		{
+			Text:   "Fallback servers",
+			Widget: endpointsEntry,
+		},
+		{
+			Text:   "Parallel streams",
+			Widget: streamCountEntry,
+		},
+		{
+			Text:     "TAP mode",
+			Widget:   tapModeCheck,
+			HintText: "Ethernet frames instead of IP packets, needs server support",
+		},
 	}
 
 	if !internal.AppState.SyncDeviceSettings {
@@ -107,19 +141,30 @@ func createSetupForm(w fyne.Window) *widget.Form {
 	return &widget.Form{
 		Items: formItems,
 		OnSubmit: func() {
+			if reloadIfProvisioned(w, BuildSetupScreen) {
+				return
+			}
 			config.AppConfig.ServerAddr = serverAddrEntry.Text
 			config.AppConfig.Key = keyEntry.Text
 			config.AppConfig.DeviceName = deviceNameEntry.Text
 
+			endpoints, err := internal.ParseEndpoints(endpointsEntry.Text)
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			internal.ClientOptions.Endpoints = endpoints
+			internal.ClientOptions.StreamCount, _ = strconv.Atoi(streamCountEntry.Text)
+			if internal.ClientOptions.StreamCount < 1 {
+				internal.ClientOptions.StreamCount = 1
+			}
+			internal.ClientOptions.TapMode = tapModeCheck.Checked
+
 			if internal.AppState.SyncDeviceSettings {
-				serverConfig, err := internal.GetServerConfiguration(config.AppConfig)
+				err := internal.SyncServerSettings(&config.AppConfig, &internal.ClientOptions)
 				if err != nil {
 					lib.ShowErrorDialog(w, err)
 					return
-				} else {
-					config.AppConfig.BufferSize = serverConfig.BufferSize
-					config.AppConfig.MTU = serverConfig.MTU
-					config.AppConfig.Compress = serverConfig.Compress
 				}
 			} else {
 				config.AppConfig.BufferSize, _ = strconv.Atoi(bufferSizeEntry.Text)
@@ -133,21 +178,24 @@ func createSetupForm(w fyne.Window) *widget.Form {
 			}
 			config.AppConfig.LocalGateway = gateway.String()
 
-			// DeviceId will be set in GetIP function
-			req, res, err := internal.GetIP(config.AppConfig)
+			// Not every network has IPv6
+			internal.ClientOptions.LocalGatewayV6 = ""
+			internal.ClientOptions.LocalGatewayV6Dev = ""
+			if gateway, err := netutil.DiscoverGateway(false); err == nil && gateway != nil {
+				internal.ClientOptions.LocalGatewayV6 = gateway.String()
+			}
+
+			err = internal.RegisterDevice(&config.AppConfig, &internal.ClientOptions)
 			if err != nil {
 				lib.ShowErrorDialog(w, err)
 				return
-			} else {
-				config.AppConfig.DeviceId = req.DeviceId
-				config.AppConfig.CIDR = res.Client
-				config.AppConfig.ServerIP = res.Server
 			}
 
 			internal.AppState.IsInitialized = true
 
 			internal.SaveStateFile(internal.AppState)
 			internal.SaveConfigFile(config.AppConfig)
+			internal.SaveOptionsFile(internal.ClientOptions)
 			log.Println("New configuration saved")
 			w.SetContent(BuildHomeScreen(w))
 		},
@@ -0,0 +1,157 @@
+package content
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+// importProfile imports a shared profile from a link or file contents,
+// asking for the passphrase if it is encrypted, and passes the name of the
+// new profile to done.
+func importProfile(w fyne.Window, data []byte, done func(string)) {
+	apply := func(passphrase string) {
+		b, err := internal.DecodeProfile(data, passphrase)
+		if err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		save := func() {
+			name, err := internal.ImportProfile(b, "", true)
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			log.Printf("Profile %s imported", name)
+			done(name)
+		}
+		warnings := internal.ProfileBundleWarnings(b)
+		if len(warnings) == 0 {
+			save()
+			return
+		}
+		message := fmt.Sprintf("Profile %s is insecure:\n\n- %s\n\nImport it anyway?", b.Name, strings.Join(warnings, "\n- "))
+		dialog.ShowConfirm("Insecure profile", message, func(ok bool) {
+			if ok {
+				save()
+			}
+		}, w)
+	}
+	if !internal.IsProfileEncrypted(data) {
+		apply("")
+		return
+	}
+	entry := widget.NewPasswordEntry()
+	items := []*widget.FormItem{{Text: "Passphrase", Widget: entry}}
+	dialog.ShowForm("Encrypted profile", "Import", "Cancel", items, func(ok bool) {
+		if ok {
+			apply(entry.Text)
+		}
+	}, w)
+}
+
+// importProfileFile asks for a profile file to import.
+func importProfileFile(w fyne.Window, done func(string)) {
+	dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		if r == nil {
+			return
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		importProfile(w, data, done)
+	}, w)
+}
+
+// showExportDialog shares a profile as a link copied to the clipboard or as
+// a JSON or YAML file, encrypted if a passphrase is given.
+func showExportDialog(w fyne.Window, name string) {
+	b, err := internal.ExportProfile(name)
+	if err != nil {
+		lib.ShowErrorDialog(w, err)
+		return
+	}
+	passphraseEntry := widget.NewPasswordEntry()
+	passphraseEntry.SetPlaceHolder("Optional")
+
+	var d dialog.Dialog
+	copyBtn := widget.NewButton("Copy link", func() {
+		link, err := internal.EncodeProfileURI(b, passphraseEntry.Text)
+		if err != nil {
+			lib.ShowErrorDialog(w, err)
+			return
+		}
+		w.Clipboard().SetContent(link)
+		d.Hide()
+	})
+	saveBtn := widget.NewButton("Save file...", func() {
+		passphrase := passphraseEntry.Text
+		d.Hide()
+		save := dialog.NewFileSave(func(wc fyne.URIWriteCloser, err error) {
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+				return
+			}
+			if wc == nil {
+				return
+			}
+			defer wc.Close()
+			data, err := internal.EncodeProfileFile(b, passphrase, internal.ProfileFileIsYAML(wc.URI().Name()))
+			if err == nil {
+				_, err = wc.Write(data)
+			}
+			if err != nil {
+				lib.ShowErrorDialog(w, err)
+			}
+		}, w)
+		save.SetFileName(name + ".json")
+		save.Show()
+	})
+
+	form := widget.NewForm(widget.NewFormItem("Passphrase", passphraseEntry))
+	hint := widget.NewLabel("The key is included, share encrypted profiles over untrusted channels.")
+	hint.Wrapping = fyne.TextWrapWord
+	content := container.NewVBox(form, hint, container.NewHBox(copyBtn, saveBtn))
+	d = dialog.NewCustom("Export "+name, "Close", content, w)
+	d.Resize(fyne.NewSize(420, 0))
+	d.Show()
+}
+
+// buildImportLinkForm imports a pasted profile link.
+func buildImportLinkForm(w fyne.Window, done func(string)) *widget.Form {
+	linkEntry := widget.NewEntry()
+	linkEntry.SetPlaceHolder(internal.ProfileURIScheme + "...")
+	return &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Profile link", Widget: linkEntry},
+		},
+		OnSubmit: func() {
+			link := strings.TrimSpace(linkEntry.Text)
+			if !strings.HasPrefix(link, internal.ProfileURIScheme) {
+				lib.ShowErrorDialog(w, errors.New("paste a link starting with "+internal.ProfileURIScheme))
+				return
+			}
+			importProfile(w, []byte(link), func(name string) {
+				linkEntry.SetText("")
+				done(name)
+			})
+		},
+		SubmitText: "Import",
+	}
+}
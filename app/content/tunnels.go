@@ -0,0 +1,138 @@
+package content
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/xorgal/xtun-client/app/lib"
+	"github.com/xorgal/xtun-client/internal"
+)
+
+// TunnelsScreen shows the main tunnel along with the profiles that can be
+// connected at the same time.
+type TunnelsScreen struct {
+	w        fyne.Window
+	profiles []string
+	statuses map[string]internal.TunnelStatus
+	list     *widget.List
+}
+
+func BuildTunnelsScreen(w fyne.Window) fyne.CanvasObject {
+	s := &TunnelsScreen{w: w}
+
+	s.list = widget.NewList(
+		func() int {
+			return len(s.profiles) + 1
+		},
+		func() fyne.CanvasObject {
+			name := widget.NewLabel("")
+			name.TextStyle = fyne.TextStyle{Bold: true}
+			return container.NewBorder(nil, nil, nil, widget.NewButton("", nil), container.NewVBox(name, widget.NewLabel("")))
+		},
+		s.updateItem,
+	)
+	s.refresh()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.refresh()
+		}
+	}()
+
+	return s.list
+}
+
+func (s *TunnelsScreen) refresh() {
+	profiles, err := internal.ListProfiles()
+	if err != nil {
+		log.Print(err)
+	}
+	s.profiles = []string{}
+	for _, name := range profiles {
+		if name != internal.GetMainProfile() {
+			s.profiles = append(s.profiles, name)
+		}
+	}
+	s.statuses = map[string]internal.TunnelStatus{}
+	for _, status := range internal.GetTunnelStatuses() {
+		s.statuses[status.Profile] = status
+	}
+	s.list.Refresh()
+}
+
+func (s *TunnelsScreen) updateItem(id widget.ListItemID, o fyne.CanvasObject) {
+	c := o.(*fyne.Container)
+	labels := c.Objects[0].(*fyne.Container)
+	ctrlBtn := c.Objects[1].(*widget.Button)
+
+	name := ""
+	if id > 0 {
+		name = s.profiles[id-1]
+	}
+	status, connected := s.statuses[name]
+	if name == "" {
+		labels.Objects[0].(*widget.Label).SetText(fmt.Sprintf("Main (%s)", internal.GetMainProfile()))
+		ctrlBtn.Hide()
+	} else {
+		labels.Objects[0].(*widget.Label).SetText(name)
+		ctrlBtn.Show()
+	}
+	if !connected {
+		status.State = internal.Disconnected
+	}
+	labels.Objects[1].(*widget.Label).SetText(formatTunnelStatus(status))
+
+	if connected {
+		ctrlBtn.SetText("Disconnect")
+		ctrlBtn.OnTapped = func() {
+			go func() {
+				if err := internal.StopTunnel(name); err != nil {
+					lib.ShowErrorDialog(s.w, err)
+				}
+			}()
+		}
+	} else {
+		ctrlBtn.SetText("Connect")
+		ctrlBtn.OnTapped = func() {
+			if err := internal.StartTunnel(name); err != nil {
+				lib.ShowErrorDialog(s.w, err)
+			}
+			s.refresh()
+		}
+	}
+}
+
+func formatTunnelStatus(status internal.TunnelStatus) string {
+	parts := []string{stateText(status.State)}
+	if status.Server != "" {
+		parts = append(parts, status.Server)
+	}
+	if status.State == internal.Connected {
+		parts = append(parts,
+			fmt.Sprintf("%s %s", status.Device, strings.Split(status.Address, "/")[0]),
+			fmt.Sprintf("read %s, written %s", formatBytes(status.ReadBytes), formatBytes(status.WrittenBytes)))
+	}
+	if status.Error != "" && status.State != internal.Connected {
+		parts = append(parts, status.Error)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func stateText(state internal.ConnectionState) string {
+	switch state {
+	case internal.Connecting:
+		return "Connecting"
+	case internal.Connected:
+		return "Connected"
+	case internal.Disconnecting:
+		return "Disconnecting"
+	}
+	return "Disconnected"
+}
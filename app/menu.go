@@ -10,8 +10,15 @@ func BuildMainMenu(a fyne.App, w fyne.Window) *fyne.MainMenu {
 	mainMenu := fyne.NewMainMenu(
 		fyne.NewMenu("File",
 			fyne.NewMenuItem("Home", func() { w.SetContent(content.BuildHomeScreen(w)) }),
+			fyne.NewMenuItem("Servers", func() { w.SetContent(content.BuildServersScreen(w)) }),
 			fyne.NewMenuItem("Log", func() { w.SetContent(lib.Log) }),
 			fyne.NewMenuItem("Preferenses", func() { w.SetContent(content.BuildSetupScreen(w)) }),
+			fyne.NewMenuItem("Routing", func() { w.SetContent(content.BuildRoutingScreen(w)) }),
+			fyne.NewMenuItem("DNS", func() { w.SetContent(content.BuildDNSScreen(w)) }),
+			fyne.NewMenuItem("Forwards", func() { w.SetContent(content.BuildForwardsScreen(w)) }),
+			fyne.NewMenuItem("Exposed", func() { w.SetContent(content.BuildExposedScreen(w)) }),
+			fyne.NewMenuItem("Profiles", func() { w.SetContent(content.BuildProfilesScreen(w)) }),
+			fyne.NewMenuItem("Tunnels", func() { w.SetContent(content.BuildTunnelsScreen(w)) }),
 			fyne.NewMenuItemSeparator(),
 			fyne.NewMenuItem("Quit", func() { a.Quit() }),
 		),
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/xorgal/xtun-client/app"
 	"github.com/xorgal/xtun-client/app/lib"
 	"github.com/xorgal/xtun-client/internal"
-	"github.com/xorgal/xtun-core/pkg/config"
 )
 
 // ===============================
@@ -25,33 +27,46 @@ func init() {
 
 	fileExists := internal.IsStateFileExists()
 	if !fileExists {
-		internal.SaveStateFile(internal.DefaultState)
+		internal.AppState = internal.DefaultState
+		internal.SaveStateFile(internal.AppState)
 	} else {
 		internal.LoadStateFile()
 	}
 
-	fileExists = internal.IsConfigFileExists()
-	if !fileExists {
-		config.AppConfig.DeviceName = "xtun"
-		config.AppConfig.Key = "xtun@2023"
-		config.AppConfig.BufferSize = 65536
-		config.AppConfig.MTU = 1500
-		config.AppConfig.InsecureSkipVerify = false
-		config.AppConfig.Compress = false
-		config.AppConfig.GlobalMode = true
-		config.AppConfig.ServerMode = false
-		config.AppConfig.GUIMode = true
-		config.AppConfig.Protocol = "wss"
-
-		internal.SaveConfigFile(config.AppConfig)
-	} else {
-		internal.LoadConfigFile()
+	// Options missing from an older file keep their defaults
+	internal.ClientOptions = internal.DefaultOptions
+	profile := internal.GetDefaultProfile()
+	if err := internal.MigrateConfig(); err != nil {
+		// A new default profile would hide the old config for good, so
+		// migration is retried on the next start
+		log.Printf("Unable to migrate configuration: %v", err)
+	} else if !internal.IsProfileExists(profile) {
+		internal.SaveProfile(profile, internal.DefaultConfig(), internal.DefaultOptions)
+	}
+	if err := internal.UseProfile(profile); err != nil {
+		log.Printf("Unable to load profile %s: %v", profile, err)
 	}
 
 	lib.InitAppLogger()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		repair()
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "tunnel" {
+		tunnel(os.Args[2])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		log.SetOutput(os.Stderr)
+		if err := profileCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := internal.SavePidFile()
 	if err != nil {
 		if os.IsExist(err) {
@@ -61,5 +76,67 @@ func main() {
 	}
 	defer internal.RmPidFile()
 
+	// Undo network changes left behind by a crashed client
+	if internal.IsJournalFileExists() {
+		if err := internal.RepairNetwork(); err != nil {
+			log.Printf("Unable to restore network configuration: %v", err)
+		}
+	}
+
 	app.RunLoop()
 }
+
+// repair restores the network configuration after a crash without
+// starting the app, or the one of the profile given. It must not be run
+// while the app or the profile is connected.
+func repair() {
+	log.SetOutput(os.Stderr)
+	if len(os.Args) > 2 {
+		if err := internal.UseProfile(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		internal.IsolateProfile()
+		if internal.IsPidFileActive() {
+			log.Fatalf("Profile %s is connected, disconnect it first.", os.Args[2])
+		}
+	} else if internal.IsPidFileActive() {
+		log.Fatalf("The app is running, close it first.")
+	}
+	if !internal.IsJournalFileExists() {
+		log.Println("Nothing to repair")
+		return
+	}
+	if err := internal.RepairNetwork(); err != nil {
+		log.Fatalf("Unable to restore network configuration: %v", err)
+	}
+	log.Println("Network configuration restored")
+}
+
+// tunnel connects a profile alongside the main tunnel, see
+// internal.StartTunnel. It disconnects once stdin is closed or on
+// interrupt.
+func tunnel(name string) {
+	log.SetOutput(os.Stderr)
+	if err := internal.UseProfile(name); err != nil {
+		log.Fatal(err)
+	}
+	internal.IsolateProfile()
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		stdinClosed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, os.Stdin)
+			close(stdinClosed)
+		}()
+		select {
+		case <-signals:
+		case <-stdinClosed:
+		}
+		close(stop)
+	}()
+	if err := internal.RunTunnel(name, stop, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
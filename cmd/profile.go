@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xorgal/xtun-client/internal"
+)
+
+const profileUsage = `usage: xtun profile <command>
+
+commands:
+  list                                  list profiles, * marking the default one
+  create <name> <server> <key> [device] register with server as a new profile
+  clone <name> <new name>               copy a profile
+  rename <name> <new name>              rename a profile
+  delete <name>                         delete a profile
+  default <name>                        use a profile for the main tunnel
+  import [-insecure] <file|link> [name] register with the server of a shared profile,
+                                        -insecure accepting one without TLS or
+                                        certificate verification
+  export <name> [file]                  print a profile as a link, or write it to a
+                                        JSON or YAML file
+  provision <name> <url> <public key>   apply the signed profile served at an HTTPS
+                                        URL, which the app then checks for updates
+  keygen                                print a new provisioning key pair
+  sign <name> <serial> <key file>       print the provisioning document of a profile,
+                                        signed with the private key in key file
+
+Shared profiles are encrypted with the passphrase in XTUN_PASSPHRASE, if
+set. Importing an encrypted profile without it asks for the passphrase.`
+
+// profileCommand manages profiles from the command line. It must not be
+// run while the app is open.
+func profileCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(profileUsage)
+	}
+	if internal.IsPidFileActive() && args[0] != "list" && args[0] != "export" && args[0] != "keygen" && args[0] != "sign" {
+		return errors.New("close the app before changing profiles")
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		profiles, err := internal.ListProfiles()
+		if err != nil {
+			return err
+		}
+		for _, name := range profiles {
+			mark := " "
+			if name == internal.GetDefaultProfile() {
+				mark = "*"
+			}
+			fmt.Printf("%s %s\n", mark, name)
+		}
+		return nil
+	case args[0] == "create" && (len(args) == 4 || len(args) == 5):
+		device := ""
+		if len(args) == 5 {
+			device = args[4]
+		}
+		return internal.NewProfile(args[1], args[2], args[3], device)
+	case args[0] == "clone" && len(args) == 3:
+		return internal.CloneProfile(args[1], args[2])
+	case args[0] == "rename" && len(args) == 3:
+		return internal.RenameProfile(args[1], args[2])
+	case args[0] == "delete" && len(args) == 2:
+		return internal.DeleteProfile(args[1])
+	case args[0] == "default" && len(args) == 2:
+		return internal.SetDefaultProfile(args[1])
+	case args[0] == "import" && len(args) > 1 && args[1] == "-insecure" && (len(args) == 3 || len(args) == 4):
+		name := ""
+		if len(args) == 4 {
+			name = args[3]
+		}
+		return importProfile(args[2], name, true)
+	case args[0] == "import" && (len(args) == 2 || len(args) == 3):
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		return importProfile(args[1], name, false)
+	case args[0] == "export" && (len(args) == 2 || len(args) == 3):
+		file := ""
+		if len(args) == 3 {
+			file = args[2]
+		}
+		return exportProfile(args[1], file)
+	case args[0] == "provision" && len(args) == 4:
+		changed, err := internal.Provision(args[1], args[2], args[3])
+		if err == nil && !changed {
+			fmt.Printf("Profile %s is up to date\n", args[1])
+		}
+		return err
+	case args[0] == "keygen" && len(args) == 1:
+		public, private, err := internal.GenerateProvisioningKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("public key:  %s\nprivate key: %s\n", public, private)
+		return nil
+	case args[0] == "sign" && len(args) == 4:
+		return signProfile(args[1], args[2], args[3])
+	}
+	return errors.New(profileUsage)
+}
+
+func importProfile(source string, name string, allowInsecure bool) error {
+	data := []byte(source)
+	if !strings.HasPrefix(source, internal.ProfileURIScheme) {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return err
+		}
+	}
+	passphrase := os.Getenv("XTUN_PASSPHRASE")
+	if passphrase == "" && internal.IsProfileEncrypted(data) {
+		fmt.Fprint(os.Stderr, "Passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		passphrase = strings.TrimRight(line, "\r\n")
+	}
+	b, err := internal.DecodeProfile(data, passphrase)
+	if err != nil {
+		return err
+	}
+	warnings := internal.ProfileBundleWarnings(b)
+	if len(warnings) > 0 && !allowInsecure {
+		return fmt.Errorf("the profile is insecure: %s\nimport it with -insecure to accept this", strings.Join(warnings, ", "))
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	name, err = internal.ImportProfile(b, name, allowInsecure)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Profile %s imported\n", name)
+	return nil
+}
+
+func exportProfile(name string, file string) error {
+	b, err := internal.ExportProfile(name)
+	if err != nil {
+		return err
+	}
+	passphrase := os.Getenv("XTUN_PASSPHRASE")
+	if file == "" {
+		link, err := internal.EncodeProfileURI(b, passphrase)
+		if err != nil {
+			return err
+		}
+		fmt.Println(link)
+		return nil
+	}
+	data, err := internal.EncodeProfileFile(b, passphrase, internal.ProfileFileIsYAML(file))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0600)
+}
+
+func signProfile(name string, serial string, keyFile string) error {
+	b, err := internal.ExportProfile(name)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(serial, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid serial %q", serial)
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := internal.SignProvision(internal.ProvisionedProfile{Serial: n, Profile: b}, strings.TrimSpace(string(key)))
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -18,7 +18,6 @@ import (
 	"github.com/gobwas/ws/wsutil"
 	"github.com/golang/snappy"
 	"github.com/google/uuid"
-	"github.com/net-byte/water"
 	"github.com/xorgal/xtun-core/pkg/cache"
 	"github.com/xorgal/xtun-core/pkg/config"
 	"github.com/xorgal/xtun-core/pkg/counter"
@@ -33,12 +32,27 @@ type RegisterDeviceResponse struct {
 	DeviceId string `json:"deviceId"`
 	Server   string `json:"server"`
 	Client   string `json:"client"`
+	ServerV6 string `json:"serverV6,omitempty"`
+	ClientV6 string `json:"clientV6,omitempty"`
+	PushedRoutes
+	PushedDNS
 }
 
 type ServerConfigurationResponse struct {
 	BufferSize int  `json:"bufferSize"`
 	MTU        int  `json:"mtu"`
 	Compress   bool `json:"compress"`
+	// TAP is set if the server can carry Ethernet frames
+	TAP bool `json:"tap,omitempty"`
+	PushedRoutes
+	PushedDNS
+}
+
+// packetDevice carries the packets of the tunnel on the local side, it is
+// either the tun interface or the userspace network stack.
+type packetDevice interface {
+	io.ReadWriteCloser
+	Name() string
 }
 
 type ErrorResponse struct {
@@ -102,37 +116,217 @@ func StartClient(config config.Config, errCh chan<- error) {
 	log.Println("Starting ws client...")
 	setConnectionState(Connecting)
 	suspended = false
-	iface, err := tun.CreateTunInterface(config)
-	if err != nil {
+	if ClientOptions.UserspaceStack && !UserStackAvailable {
+		log.Println(errUserStackUnavailable)
+		setConnectionState(Disconnected)
+		reportError(errCh, errUserStackUnavailable)
+		return
+	}
+	if err := checkRouteOptions(ClientOptions); err != nil {
 		log.Println(err)
-		errCh <- err
+		setConnectionState(Disconnected)
+		reportError(errCh, err)
 		return
 	}
-	cache.GetCache().Set("iface", iface, 24*time.Hour)
-	go tunToWs(config, iface)
+	if ClientOptions.TapMode {
+		// Connections dialed in parallel must all announce the same MAC
+		mac, err := tapMAC(ClientOptions)
+		if err != nil {
+			log.Println(err)
+			setConnectionState(Disconnected)
+			reportError(errCh, err)
+			return
+		}
+		cache.GetCache().Set("tapmac", mac, 24*time.Hour)
+	}
+	if ClientOptions.KillSwitch {
+		// Stays in place across reconnects until StopClient
+		// The interface may be named differently, see startTun
+		if err := enableKillSwitch(config, ClientOptions, config.DeviceName); err != nil {
+			log.Println(err)
+			setConnectionState(Disconnected)
+			reportError(errCh, err)
+			return
+		}
+	}
+	startSleepWatcher()
+	pool := newEndpointPool(config, ClientOptions)
+	fallbackInterval := time.Duration(ClientOptions.FallbackInterval) * time.Second
+	var iface packetDevice
 	for {
+		waitResume()
 		if suspended {
 			return
 		}
+		config.ServerAddr = pool.Current().Addr
+		setActiveEndpoint(config.ServerAddr)
+		discoverGateways(&config)
+		if err := pinServerRoutes(config); err != nil {
+			log.Println(err)
+			if iface == nil && !IsSplitTunnel(MergeRoutes(ClientOptions)) {
+				// Switching the default route would send the connection
+				// to the server into the tunnel
+				unpinServerRoutes()
+				disableKillSwitch()
+				stopSleepWatcher()
+				setConnectionState(Disconnected)
+				reportError(errCh, err)
+				return
+			}
+			reportError(errCh, err)
+		}
 		conn, err := connect(config)
 		if err != nil {
 			log.Println(err)
-			errCh <- err
+			pool.Fail()
+			reportError(errCh, err)
 		}
 		if conn == nil {
 			setConnectionState(Disconnected)
 			time.Sleep(3 * time.Second)
 			continue
 		}
-		setConnectionState(Connected)
+		pool.Succeed()
+		if iface == nil {
+			iface, err = startTun(config)
+			if err != nil {
+				conn.Close()
+				unpinServerRoutes()
+				disableKillSwitch()
+				stopSleepWatcher()
+				log.Println(err)
+				setConnectionState(Disconnected)
+				reportError(errCh, err)
+				return
+			}
+			if ClientOptions.KillSwitch && iface.Name() != config.DeviceName {
+				if err := enableKillSwitch(config, ClientOptions, iface.Name()); err != nil {
+					log.Printf("unable to let %s through the kill switch: %v", iface.Name(), err)
+				}
+			}
+		}
+		sessionMutex.Lock()
 		cache.GetCache().Set("wsconn", conn, 24*time.Hour)
+		setConnectionState(Connected)
+		sessionMutex.Unlock()
 		go wsToTun(config, conn, iface)
-		ping(conn, config)
-		cache.GetCache().Delete("wsconn")
-		setConnectionState(Disconnected)
+		stop := make(chan struct{})
+		go probePrimary(config, pool, fallbackInterval, stop)
+		for {
+			failed := ping(config)
+			sessionMutex.Lock()
+			if current := getWsConn(); current != nil && current != failed {
+				// Migrated while the old connection failed
+				sessionMutex.Unlock()
+				continue
+			}
+			cache.GetCache().Delete("wsconn")
+			setConnectionState(Disconnected)
+			sessionMutex.Unlock()
+			break
+		}
+		close(stop)
 	}
 }
 
+// reportError passes err to the caller of StartClient without blocking,
+// so that a caller not reading errCh can't stall the client.
+func reportError(errCh chan<- error, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
+}
+
+// startTun creates the tun interface, or the userspace stack, once the
+// first connection is up, so that routes are set up for the server address
+// actually connected to.
+func startTun(config config.Config) (packetDevice, error) {
+	if ClientOptions.AcceptServerRoutes || ClientOptions.ApplyDNS {
+		refreshServerConfig(config)
+	}
+	var iface packetDevice
+	var err error
+	switch {
+	case ClientOptions.UserspaceStack && ClientOptions.TapMode:
+		return nil, errors.New("TAP mode is not available with the userspace stack")
+	case ClientOptions.UserspaceStack:
+		iface, err = startUserStack(config)
+	case ClientOptions.TapMode:
+		iface, err = createTap(config)
+	default:
+		iface, err = createTun(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.GetCache().Set("iface", iface, 24*time.Hour)
+	cache.GetCache().Set("netwatch", startNetworkWatcher(config, iface.Name()), 24*time.Hour)
+	go tunToWs(config, iface)
+	if ClientOptions.StreamCount > 1 {
+		streams := startStreams(config, iface, ClientOptions.StreamCount-1)
+		cache.GetCache().Set("streams", streams, 24*time.Hour)
+	}
+	if len(ClientOptions.Forwards) > 0 {
+		// The routes take care of sending forwarded traffic into the tun
+		// interface
+		var dialer contextDialer = &net.Dialer{}
+		if d, ok := iface.(*userspaceDevice); ok {
+			dialer = d.dialer
+		}
+		cache.GetCache().Set("forwards", startForwards(dialer, ClientOptions.Forwards), 24*time.Hour)
+	}
+	if len(ClientOptions.ReverseForwards) > 0 {
+		var listener tunnelListener = hostListener{}
+		if d, ok := iface.(*userspaceDevice); ok {
+			listener = d
+		}
+		if s, err := startReverseForwards(listener, config, ClientOptions); err != nil {
+			log.Print(err)
+		} else {
+			cache.GetCache().Set("reverseforwards", s, 24*time.Hour)
+		}
+	}
+	return iface, nil
+}
+
+// createTun creates the tun interface and sets up routing for it.
+func createTun(config config.Config) (packetDevice, error) {
+	tunConfig := config
+	if addr := GetConnectedAddr(); addr != "" {
+		tunConfig.ServerAddr = addr
+	}
+	if routesSupported && (IsSplitTunnel(MergeRoutes(ClientOptions)) || ClientOptions.PolicyRouting) {
+		// Either only the included prefixes are routed through the tunnel
+		// or the routes go to a dedicated table, see setupRouting
+		tunConfig.GlobalMode = false
+	}
+	tunEntry := JournalEntry{Kind: JournalTun, Config: &tunConfig}
+	journalRecord(tunEntry)
+	iface, err := tun.CreateTunInterface(tunConfig)
+	if err != nil {
+		tun.ResetRoute(tunConfig)
+		journalForget(tunEntry)
+		return nil, err
+	}
+	if err := setupRouting(iface.Name(), tunConfig); err != nil {
+		iface.Close()
+		tun.ResetRoute(tunConfig)
+		journalForget(tunEntry)
+		return nil, err
+	}
+	cache.GetCache().Set("tunconfig", tunConfig, 24*time.Hour)
+	return iface, nil
+}
+
+// getTunConfig returns the config the tun interface was created with.
+func getTunConfig() (config.Config, bool) {
+	if v, ok := cache.GetCache().Get("tunconfig"); ok {
+		return v.(config.Config), true
+	}
+	return config.Config{}, false
+}
+
 func StopClient(config config.Config) error {
 	log.Println("Stopping ws client...")
 	setConnectionState(Disconnecting)
@@ -145,8 +339,20 @@ func StopClient(config config.Config) error {
 			}
 		}
 	}
+	if v, ok := cache.GetCache().Get("netwatch"); ok {
+		v.(*networkWatcher).Close()
+	}
+	if v, ok := cache.GetCache().Get("streams"); ok {
+		v.(*streamSet).Close()
+	}
+	if v, ok := cache.GetCache().Get("forwards"); ok {
+		v.(*forwardSet).Close()
+	}
+	if v, ok := cache.GetCache().Get("reverseforwards"); ok {
+		v.(*reverseForwardSet).Close()
+	}
 	if v, ok := cache.GetCache().Get("iface"); ok {
-		iface := v.(*water.Interface)
+		iface := v.(packetDevice)
 		if iface != nil {
 			err := iface.Close()
 			if err != nil {
@@ -155,9 +361,29 @@ func StopClient(config config.Config) error {
 		}
 	}
 	cache.GetCache().Delete("wsconn")
+	cache.GetCache().Delete("netwatch")
+	cache.GetCache().Delete("streams")
+	cache.GetCache().Delete("forwards")
+	cache.GetCache().Delete("reverseforwards")
 	cache.GetCache().Delete("iface")
-	tun.ResetRoute(config)
+	cache.GetCache().Delete("tapmac")
+	teardownRouting()
+	unpinServerRoutes()
+	tunConfig, ok := getTunConfig()
+	if ok {
+		config = tunConfig
+		cache.GetCache().Delete("tunconfig")
+	}
+	if !ClientOptions.UserspaceStack && !ClientOptions.TapMode {
+		tun.ResetRoute(config)
+	}
+	if ok {
+		journalForget(JournalEntry{Kind: JournalTun, Config: &tunConfig})
+	}
+	setActiveEndpoint("")
+	disableKillSwitch()
 	suspended = true
+	stopSleepWatcher()
 	setConnectionState(Disconnected)
 	return nil
 }
@@ -178,15 +404,20 @@ func connect(config config.Config) (net.Conn, error) {
 	if config.Key != "" {
 		header.Set("key", config.Key)
 	}
+	if mac := sessionTapMAC(); ClientOptions.TapMode && mac != "" {
+		header.Set("mode", "tap")
+		header.Set("mac", mac)
+	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.InsecureSkipVerify,
 	}
+	dialTimeout := time.Duration(ClientOptions.DialTimeout) * time.Second
 	dialer := ws.Dialer{
 		Header:    ws.HandshakeHeaderHTTP(header),
 		Timeout:   time.Duration(120) * time.Second,
 		TLSConfig: tlsConfig,
 		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return net.Dial(network, config.ServerAddr)
+			return dialServer(ctx, network, config.ServerAddr, dialTimeout)
 		},
 	}
 	c, _, _, err := dialer.Dial(context.Background(), u.String())
@@ -196,26 +427,41 @@ func connect(config config.Config) (net.Conn, error) {
 	return c, err
 }
 
-func ping(wsconn net.Conn, config config.Config) {
-	defer wsconn.Close()
+// ping keeps the current ws connection alive and returns once it is gone.
+// A connection replaced by MigrateConnection is not treated as a failure.
+// ping keeps the primary connection alive until it fails, and returns the
+// failed connection.
+func ping(config config.Config) net.Conn {
 	for {
+		wsconn := getWsConn()
+		if wsconn == nil {
+			return nil
+		}
 		err := wsutil.WriteClientMessage(wsconn, ws.OpText, []byte("ping"))
 		if err != nil {
-			break
+			if wsconn != getWsConn() {
+				continue
+			}
+			wsconn.Close()
+			return wsconn
 		}
 		time.Sleep(3 * time.Second)
 	}
 }
 
 // wsToTun sends packets from ws to tun
-func wsToTun(config config.Config, wsconn net.Conn, iface *water.Interface) {
+func wsToTun(config config.Config, wsconn net.Conn, iface packetDevice) {
 	defer wsconn.Close()
 	for {
-		packet, err := wsutil.ReadServerBinary(wsconn)
+		packet, op, err := wsutil.ReadServerData(wsconn)
 		if err != nil {
 			log.Print(err)
 			break
 		}
+		if op == ws.OpText {
+			handleControlMessage(config, packet)
+			continue
+		}
 		if config.Compress {
 			packet, _ = snappy.Decode(nil, packet)
 		}
@@ -229,7 +475,7 @@ func wsToTun(config config.Config, wsconn net.Conn, iface *water.Interface) {
 }
 
 // tunToWs sends packets from tun to ws
-func tunToWs(config config.Config, iface *water.Interface) {
+func tunToWs(config config.Config, iface packetDevice) {
 	packet := make([]byte, config.BufferSize)
 	for {
 		n, err := iface.Read(packet)
@@ -237,12 +483,11 @@ func tunToWs(config config.Config, iface *water.Interface) {
 			log.Print(err)
 			break
 		}
-		if v, ok := cache.GetCache().Get("wsconn"); ok {
+		if wsconn := pickWsConn(packet[:n]); wsconn != nil {
 			b := packet[:n]
 			if config.Compress {
 				b = snappy.Encode(nil, b)
 			}
-			wsconn := v.(net.Conn)
 			if err = wsutil.WriteClientBinary(wsconn, b); err != nil {
 				log.Print(err)
 				continue
@@ -252,12 +497,32 @@ func tunToWs(config config.Config, iface *water.Interface) {
 	}
 }
 
+// getWsConn returns the ws connection currently carrying traffic, if any.
+func getWsConn() net.Conn {
+	if v, ok := cache.GetCache().Get("wsconn"); ok {
+		return v.(net.Conn)
+	}
+	return nil
+}
+
 func setConnectionState(state ConnectionState) {
 	connMutex.Lock()
 	connectionState = state
 	connMutex.Unlock()
 }
 
+// IsClientActive reports whether the client left network changes for
+// StopClient to undo, which is also the case while it reconnects.
+func IsClientActive() bool {
+	if GetConnectionState() != Disconnected {
+		return true
+	}
+	if _, ok := cache.GetCache().Get("iface"); ok {
+		return true
+	}
+	return IsKillSwitchEnabled()
+}
+
 // use this function to safely read isConnected
 func GetConnectionState() ConnectionState {
 	connMutex.Lock()
@@ -303,6 +568,7 @@ func getHttpClient(config config.Config) http.Client {
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: config.InsecureSkipVerify,
 			},
+			DialContext: newDialer(30 * time.Second).DialContext,
 		},
 		Timeout: time.Duration(120) * time.Second,
 	}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// ControlMessage is an in-band message sent by the server as a ws text frame.
+type ControlMessage struct {
+	Type string `json:"type"`
+	PushedRoutes
+	PushedDNS
+}
+
+const (
+	// ControlMigrate asks the client to move to a fresh connection.
+	ControlMigrate = "migrate"
+	// ControlRoutes delivers an updated list of server routes.
+	ControlRoutes = "routes"
+	// ControlDNS delivers an updated DNS configuration.
+	ControlDNS = "dns"
+)
+
+func handleControlMessage(config config.Config, payload []byte) {
+	var msg ControlMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		// Not a control message, e.g. a reply to ping
+		return
+	}
+	switch msg.Type {
+	case ControlMigrate:
+		go func() {
+			if err := MigrateConnection(config); err != nil {
+				log.Print(err)
+			}
+		}()
+	case ControlRoutes:
+		if ClientOptions.AcceptServerRoutes {
+			go applyPushedRoutes(msg.PushedRoutes)
+		}
+	case ControlDNS:
+		if ClientOptions.ApplyDNS {
+			go applyPushedDNS(msg.PushedDNS)
+		}
+	default:
+		log.Printf("unknown control message: %s", msg.Type)
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// AttemptDelay is the delay between starting connection attempts to
+// successive server addresses (RFC 8305 "Connection Attempt Delay").
+var AttemptDelay = 250 * time.Millisecond
+
+var (
+	connectedAddr string
+	dialMutex     sync.Mutex
+)
+
+// GetConnectedAddr returns the ip:port the last successful dial reached.
+func GetConnectedAddr() string {
+	dialMutex.Lock()
+	defer dialMutex.Unlock()
+	return connectedAddr
+}
+
+func setConnectedAddr(addr string) {
+	dialMutex.Lock()
+	connectedAddr = addr
+	dialMutex.Unlock()
+}
+
+// newDialer returns a dialer for connections to the server, which must
+// not be routed through the tunnel.
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: markSocket,
+	}
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialServer resolves addr and races connection attempts to all of its
+// addresses, IPv6 and IPv4 interleaved, starting a new attempt every
+// AttemptDelay or as soon as the previous one fails. The first connection
+// established wins and the others are abandoned.
+func dialServer(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupServer(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	candidates := interleaveFamilies(ips)
+	if len(candidates) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(candidates))
+	attempt := func(ip net.IP) {
+		conn, err := newDialer(timeout).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		results <- dialResult{conn, err}
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+	started, pending := 0, 0
+	var lastErr error
+	for {
+		select {
+		case <-next.C:
+			go attempt(candidates[started])
+			started++
+			pending++
+			if started < len(candidates) {
+				next.Reset(AttemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go closeLateConns(results, pending)
+				setConnectedAddr(r.conn.RemoteAddr().String())
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if pending == 0 {
+				if started == len(candidates) {
+					return nil, lastErr
+				}
+				// Don't wait out the delay when nothing is in flight
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+				next.Reset(0)
+			}
+		case <-ctx.Done():
+			go closeLateConns(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// closeLateConns closes connections that lost the race.
+func closeLateConns(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies orders addresses IPv6 first, alternating between
+// address families.
+func interleaveFamilies(addrs []net.IPAddr) []net.IP {
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP)
+		} else {
+			v6 = append(v6, a.IP)
+		}
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	return ips
+}
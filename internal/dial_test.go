@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := func(ips ...string) []net.IPAddr {
+		a := []net.IPAddr{}
+		for _, ip := range ips {
+			a = append(a, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return a
+	}
+	tests := []struct {
+		name  string
+		addrs []net.IPAddr
+		want  []string
+	}{
+		{"empty", nil, []string{}},
+		{"ipv4 only", addrs("192.0.2.1", "192.0.2.2"), []string{"192.0.2.1", "192.0.2.2"}},
+		{"ipv6 only", addrs("2001:db8::1", "2001:db8::2"), []string{"2001:db8::1", "2001:db8::2"}},
+		{"ipv6 first", addrs("192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"), []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{"more ipv4", addrs("192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3"), []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{"mapped ipv4", addrs("::ffff:192.0.2.1", "2001:db8::1"), []string{"2001:db8::1", "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, ip := range interleaveFamilies(tt.addrs) {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: interleaveFamilies = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
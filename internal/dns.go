@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+)
+
+// PushedDNS is the DNS configuration advertised by the server.
+type PushedDNS struct {
+	Servers []string `json:"dns,omitempty"`
+	Domains []string `json:"searchDomains,omitempty"`
+}
+
+// dnsBackup describes how the host DNS configuration was changed, so that
+// it can be restored.
+type dnsBackup struct {
+	// Dev is the link configured through systemd-resolved
+	Dev string `json:",omitempty"`
+	// Backup is a copy of the replaced resolv.conf
+	Backup string `json:",omitempty"`
+	// Link is the target resolv.conf pointed to, if it was a symlink
+	Link string `json:",omitempty"`
+}
+
+var errDNSUnsupported = errors.New("DNS configuration is not supported on this platform")
+
+// dnsBlockTable is the nftables table blocking DNS outside the tunnel.
+const dnsBlockTable = "xtun_dns"
+
+// applyDNS points the host resolver at the DNS servers pushed by the
+// server, or at the local resolver when it forwards all queries or serves
+// domain routes, through systemd-resolved when available or by replacing
+// resolv.conf otherwise. With systemd-resolved and domain routes alone,
+// only the queries of the routed domains go to the local resolver. Domain
+// routes are set up even without ApplyDNS, as routing domains that leave
+// the rest of the host DNS alone.
+func applyDNS(dev string, options IClientOptions) error {
+	dns := options.ServerDNS
+	routingDomains := []string{}
+	resolverPort := "53"
+	if options.DNSForwarder || len(options.DomainRoutes) > 0 {
+		host, port, err := net.SplitHostPort(options.ResolverAddr)
+		if err != nil {
+			return err
+		}
+		dns.Servers = []string{host}
+		resolverPort = port
+		for _, rule := range options.DomainRoutes {
+			routingDomains = append(routingDomains, "~"+strings.TrimPrefix(strings.TrimSuffix(rule, "."), "*."))
+		}
+	}
+	domainsOnly := !options.ApplyDNS && len(options.DomainRoutes) > 0
+	if (!options.ApplyDNS && !domainsOnly) || len(dns.Servers) == 0 {
+		return nil
+	}
+	if !dnsSupported {
+		log.Printf("%v, not using %s", errDNSUnsupported, strings.Join(dns.Servers, ", "))
+		return nil
+	}
+	// Only a full tunnel should capture all queries
+	full := !IsSplitTunnel(MergeRoutes(options))
+	if domainsOnly {
+		if !hasResolved() {
+			return errors.New("domain routes need systemd-resolved, or Server DNS to point the host at the local resolver")
+		}
+		dns.Domains, full = nil, false
+	}
+	var backup dnsBackup
+	var err error
+	if hasResolved() {
+		linkDNS := dns
+		if resolverPort != "53" {
+			linkDNS.Servers = []string{net.JoinHostPort(dns.Servers[0], resolverPort)}
+		}
+		linkDNS.Domains = append(append([]string{}, dns.Domains...), routingDomains...)
+		backup = dnsBackup{Dev: dev}
+		journalRecord(JournalEntry{Kind: JournalDNS, DNS: &backup})
+		err = applyResolved(dev, linkDNS, full)
+	} else {
+		if resolverPort != "53" {
+			return fmt.Errorf("the local resolver must listen on port 53 to be used by the host, not %s", resolverPort)
+		}
+		backup, err = backupResolvConf()
+		if err != nil {
+			return err
+		}
+		journalRecord(JournalEntry{Kind: JournalDNS, DNS: &backup})
+		err = writeResolvConf(resolvConf(dns))
+	}
+	if err != nil {
+		restoreDNS(backup)
+		journalForget(JournalEntry{Kind: JournalDNS, DNS: &backup})
+		return err
+	}
+	cacheDNSBackup(backup)
+	log.Printf("DNS set to %s", strings.Join(dns.Servers, ", "))
+
+	if options.BlockOffTunnelDNS {
+		journalRecord(JournalEntry{Kind: JournalDNSBlock})
+		if err := applyRuleset(dnsBlockRuleset(dev)); err != nil {
+			journalForget(JournalEntry{Kind: JournalDNSBlock})
+			revertDNS()
+			return err
+		}
+		cache.GetCache().Set("dnsblock", true, 24*time.Hour)
+	}
+	return nil
+}
+
+// revertDNS undoes applyDNS.
+func revertDNS() {
+	if backup, ok := getDNSBackup(); ok {
+		if err := restoreDNS(backup); err != nil {
+			log.Print(err)
+		}
+		journalForget(JournalEntry{Kind: JournalDNS, DNS: &backup})
+		log.Println("DNS configuration restored")
+	}
+	if _, ok := cache.GetCache().Get("dnsblock"); ok {
+		cache.GetCache().Delete("dnsblock")
+		deleteRuleset(dnsBlockTable)
+		journalForget(JournalEntry{Kind: JournalDNSBlock})
+	}
+}
+
+func restoreDNS(backup dnsBackup) error {
+	if backup.Dev != "" {
+		return revertResolved(backup.Dev)
+	}
+	return restoreResolvConf(backup)
+}
+
+func resolvConf(dns PushedDNS) string {
+	var b strings.Builder
+	b.WriteString("# Generated by xtun-client, restored on disconnect\n")
+	for _, server := range dns.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(dns.Domains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(dns.Domains, " "))
+	}
+	return b.String()
+}
+
+// dnsBlockRuleset drops DNS queries leaving through any interface but the
+// tunnel. Loopback stays open for local stub resolvers.
+func dnsBlockRuleset(dev string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", dnsBlockTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\toifname { \"lo\", %q } accept\n", dev)
+	b.WriteString("\t\tudp dport 53 drop\n")
+	b.WriteString("\t\ttcp dport 53 drop\n")
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func cacheDNSBackup(backup dnsBackup) {
+	cache.GetCache().Set("dns", backup, 24*time.Hour)
+}
+
+func getDNSBackup() (dnsBackup, bool) {
+	if v, ok := cache.GetCache().Get("dns"); ok {
+		cache.GetCache().Delete("dns")
+		return v.(dnsBackup), true
+	}
+	return dnsBackup{}, false
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// dnsSupported reports whether the host DNS configuration can be changed
+// on this platform.
+const dnsSupported = true
+
+// hasResolved reports whether systemd-resolved manages DNS.
+func hasResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	return exec.Command("resolvectl", "status").Run() == nil
+}
+
+func applyResolved(dev string, dns PushedDNS, full bool) error {
+	if err := execCmd("resolvectl", append([]string{"dns", dev}, dns.Servers...)...); err != nil {
+		return err
+	}
+	domains := dns.Domains
+	if full {
+		// Route all queries to the tunnel link
+		domains = append(append([]string{}, domains...), "~.")
+	}
+	if len(domains) > 0 {
+		if err := execCmd("resolvectl", append([]string{"domain", dev}, domains...)...); err != nil {
+			return err
+		}
+	}
+	return execCmd("resolvectl", "default-route", dev, fmt.Sprint(full))
+}
+
+func revertResolved(dev string) error {
+	return execCmd("resolvectl", "revert", dev)
+}
+
+// backupResolvConf saves resolv.conf, or the target it links to, next to
+// the app data.
+func backupResolvConf() (dnsBackup, error) {
+	if link, err := os.Readlink(resolvConfPath); err == nil {
+		return dnsBackup{Link: link}, nil
+	}
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return dnsBackup{}, err
+	}
+	backup := fmt.Sprintf("%s/%s", DirPath.AppDataDir, "resolv.conf.backup")
+	if err := os.WriteFile(backup, data, 0644); err != nil {
+		return dnsBackup{}, err
+	}
+	return dnsBackup{Backup: backup}, nil
+}
+
+func writeResolvConf(content string) error {
+	// Replace a symlink instead of writing through it
+	os.Remove(resolvConfPath)
+	return os.WriteFile(resolvConfPath, []byte(content), 0644)
+}
+
+func restoreResolvConf(backup dnsBackup) error {
+	switch {
+	case backup.Link != "":
+		os.Remove(resolvConfPath)
+		return os.Symlink(backup.Link, resolvConfPath)
+	case backup.Backup != "":
+		data, err := os.ReadFile(backup.Backup)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(resolvConfPath, data, 0644); err != nil {
+			return err
+		}
+		return os.Remove(backup.Backup)
+	}
+	return errors.New("no resolv.conf backup to restore")
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package internal
+
+const dnsSupported = false
+
+func hasResolved() bool {
+	return false
+}
+
+func applyResolved(dev string, dns PushedDNS, full bool) error {
+	return errDNSUnsupported
+}
+
+func revertResolved(dev string) error {
+	return errDNSUnsupported
+}
+
+func backupResolvConf() (dnsBackup, error) {
+	return dnsBackup{}, errDNSUnsupported
+}
+
+func writeResolvConf(content string) error {
+	return errDNSUnsupported
+}
+
+func restoreResolvConf(backup dnsBackup) error {
+	return errDNSUnsupported
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSCacheSize is the maximum number of responses kept by the resolver.
+var DNSCacheSize = 4096
+
+// NegativeCacheTTL is used for answers without records when the server
+// doesn't provide an SOA to take the TTL from.
+var NegativeCacheTTL = 60 * time.Second
+
+type dnsCacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps upstream responses until their smallest TTL runs out.
+type dnsCache struct {
+	sync.Mutex
+
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: map[dnsCacheKey]dnsCacheEntry{}}
+}
+
+func cacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+}
+
+// get returns the cached response to q with the given ID and its TTLs
+// lowered by the time spent in the cache.
+func (c *dnsCache) get(q dnsmessage.Question, id uint16) []byte {
+	key := cacheKey(q)
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.Unlock()
+	if !ok {
+		return nil
+	}
+	msg := e.msg
+	msg.ID = id
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	msg.Answers = ageResources(msg.Answers, elapsed)
+	msg.Authorities = ageResources(msg.Authorities, elapsed)
+	msg.Additionals = ageResources(msg.Additionals, elapsed)
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// put caches response for q. Truncated responses and failures other than
+// NXDOMAIN are not cached.
+func (c *dnsCache) put(q dnsmessage.Question, response []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	ttl := responseTTL(msg)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= DNSCacheSize {
+		c.evict(now)
+	}
+	c.entries[cacheKey(q)] = dnsCacheEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// evict drops expired entries, or an arbitrary one if none has expired.
+func (c *dnsCache) evict(now time.Time) {
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < DNSCacheSize {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+// responseTTL returns the smallest TTL of the answers, or for negative
+// answers the SOA minimum as per RFC 2308.
+func responseTTL(msg dnsmessage.Message) time.Duration {
+	if len(msg.Answers) == 0 {
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				ttl := r.Header.TTL
+				if soa.MinTTL < ttl {
+					ttl = soa.MinTTL
+				}
+				return time.Duration(ttl) * time.Second
+			}
+		}
+		return NegativeCacheTTL
+	}
+	ttl := msg.Answers[0].Header.TTL
+	for _, r := range msg.Answers[1:] {
+		if r.Header.TTL < ttl {
+			ttl = r.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ageResources returns a copy of resources with TTLs lowered by elapsed
+// seconds. The OPT pseudo-record has no TTL and is left alone.
+func ageResources(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(resources))
+	for i, r := range resources {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			if r.Header.TTL > elapsed {
+				r.Header.TTL -= elapsed
+			} else {
+				r.Header.TTL = 0
+			}
+		}
+		aged[i] = r
+	}
+	return aged
+}
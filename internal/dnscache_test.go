@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testQuestion(name string) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+}
+
+// testResponse returns a response to q with an A record per TTL.
+func testResponse(q dnsmessage.Question, rcode dnsmessage.RCode, truncated bool, ttls ...uint32) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true, RCode: rcode, Truncated: truncated},
+		Questions: []dnsmessage.Question{q},
+	}
+	for _, ttl := range ttls {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		})
+	}
+	response, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return response
+}
+
+func TestResponseTTL(t *testing.T) {
+	soa := func(ttl, minTTL uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), MinTTL: minTTL},
+		}
+	}
+	a := func(ttl uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{TTL: ttl}, Body: &dnsmessage.AResource{}}
+	}
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		ttl  time.Duration
+	}{
+		{"smallest answer", dnsmessage.Message{Answers: []dnsmessage.Resource{a(300), a(30), a(600)}}, 30 * time.Second},
+		{"soa minimum", dnsmessage.Message{Authorities: []dnsmessage.Resource{soa(3600, 120)}}, 120 * time.Second},
+		{"soa ttl", dnsmessage.Message{Authorities: []dnsmessage.Resource{soa(60, 900)}}, 60 * time.Second},
+		{"no soa", dnsmessage.Message{}, NegativeCacheTTL},
+	}
+	for _, tt := range tests {
+		if ttl := responseTTL(tt.msg); ttl != tt.ttl {
+			t.Errorf("%s: responseTTL = %v, want %v", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	q := testQuestion("host.example.")
+	tests := []struct {
+		name     string
+		response []byte
+		cached   bool
+	}{
+		{"answer", testResponse(q, dnsmessage.RCodeSuccess, false, 300), true},
+		{"nxdomain", testResponse(q, dnsmessage.RCodeNameError, false), true},
+		{"servfail", testResponse(q, dnsmessage.RCodeServerFailure, false), false},
+		{"truncated", testResponse(q, dnsmessage.RCodeSuccess, true, 300), false},
+		{"zero ttl", testResponse(q, dnsmessage.RCodeSuccess, false, 0, 300), false},
+		{"garbage", []byte{1, 2, 3}, false},
+	}
+	for _, tt := range tests {
+		c := newDNSCache()
+		c.put(q, tt.response)
+		// Names are case-insensitive
+		response := c.get(testQuestion("HOST.Example."), 42)
+		if (response != nil) != tt.cached {
+			t.Errorf("%s: cached = %v, want %v", tt.name, response != nil, tt.cached)
+			continue
+		}
+		if response == nil {
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(response); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != 42 {
+			t.Errorf("%s: ID = %d, want the one of the query", tt.name, msg.ID)
+		}
+	}
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	q := testQuestion("host.example.")
+	c := newDNSCache()
+	c.put(q, testResponse(q, dnsmessage.RCodeSuccess, false, 300))
+
+	// TTLs are lowered by the time spent in the cache
+	key := cacheKey(q)
+	e := c.entries[key]
+	e.stored = e.stored.Add(-100 * time.Second)
+	c.entries[key] = e
+	var msg dnsmessage.Message
+	if err := msg.Unpack(c.get(q, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("TTL = %d, want 200", ttl)
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	c.entries[key] = e
+	if c.get(q, 1) != nil {
+		t.Error("expired response returned")
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("expired response kept")
+	}
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	size := DNSCacheSize
+	DNSCacheSize = 2
+	defer func() { DNSCacheSize = size }()
+
+	c := newDNSCache()
+	names := []string{"a.example.", "b.example.", "c.example."}
+	for _, name := range names {
+		q := testQuestion(name)
+		c.put(q, testResponse(q, dnsmessage.RCodeSuccess, false, 300))
+	}
+	if len(c.entries) != DNSCacheSize {
+		t.Errorf("%d entries cached, want %d", len(c.entries), DNSCacheSize)
+	}
+	if c.get(testQuestion("c.example."), 1) == nil {
+		t.Error("the last response was evicted")
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MinDomainRouteTTL keeps routes learned from short-lived DNS answers
+// around long enough for the connection to be established.
+var MinDomainRouteTTL = 60 * time.Second
+
+// MatchDomain reports whether name matches one of rules. A rule like
+// "internal.corp" matches the domain and its subdomains, "*.git.example"
+// matches subdomains only.
+func MatchDomain(rules []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rule), "."))
+		if suffix, ok := strings.CutPrefix(rule, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+		} else if name == rule || strings.HasSuffix(name, "."+rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainRoutes tracks host routes added for DNS answers of matching names
+// until their TTL expires.
+type domainRoutes struct {
+	sync.Mutex
+
+	rules   []string
+	dev     string
+	expires map[netip.Addr]time.Time
+	stop    chan struct{}
+}
+
+func newDomainRoutes(rules []string, dev string) *domainRoutes {
+	d := &domainRoutes{
+		rules:   rules,
+		dev:     dev,
+		expires: map[netip.Addr]time.Time{},
+		stop:    make(chan struct{}),
+	}
+	go d.expire()
+	return d
+}
+
+// learn inspects a DNS response and routes the A/AAAA records of matching
+// names through the tunnel.
+func (d *domainRoutes) learn(response []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(response); err != nil {
+		return
+	}
+	q, err := p.Question()
+	if err != nil || !MatchDomain(d.rules, q.Name.String()) {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		var addr netip.Addr
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return
+			}
+			addr = netip.AddrFrom4(r.A)
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return
+			}
+			addr = netip.AddrFrom16(r.AAAA)
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		if ttl < MinDomainRouteTTL {
+			ttl = MinDomainRouteTTL
+		}
+		d.add(addr, ttl)
+	}
+}
+
+func (d *domainRoutes) add(addr netip.Addr, ttl time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	expires := time.Now().Add(ttl)
+	if _, ok := d.expires[addr]; !ok {
+		if err := applyRoute(d.route(addr)); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	if expires.After(d.expires[addr]) {
+		d.expires[addr] = expires
+	}
+}
+
+func (d *domainRoutes) route(addr netip.Addr) Route {
+	return Route{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Dev: d.dev}
+}
+
+func (d *domainRoutes) expire() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			d.Lock()
+			for addr, expires := range d.expires {
+				if now.After(expires) {
+					revertRoute(d.route(addr))
+					delete(d.expires, addr)
+				}
+			}
+			d.Unlock()
+		}
+	}
+}
+
+// Close removes all routes that were learned.
+func (d *domainRoutes) Close() {
+	close(d.stop)
+	d.Lock()
+	defer d.Unlock()
+	for addr := range d.expires {
+		revertRoute(d.route(addr))
+		delete(d.expires, addr)
+	}
+}
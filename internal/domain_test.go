@@ -0,0 +1,33 @@
+package internal
+
+import "testing"
+
+func TestMatchDomain(t *testing.T) {
+	rules := []string{"internal.corp", "*.git.example", " Mixed.Case. "}
+	tests := []struct {
+		name  string
+		match bool
+	}{
+		{"internal.corp", true},
+		{"internal.corp.", true},
+		{"host.internal.corp", true},
+		{"HOST.Internal.Corp", true},
+		{"notinternal.corp", false},
+		{"internal.corp.evil", false},
+		{"git.example", false},
+		{"repo.git.example", true},
+		{"a.repo.git.example", true},
+		{"mygit.example", false},
+		{"mixed.case", true},
+		{"www.mixed.case", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if match := MatchDomain(rules, tt.name); match != tt.match {
+			t.Errorf("MatchDomain(%q) = %v, want %v", tt.name, match, tt.match)
+		}
+	}
+	if MatchDomain(nil, "internal.corp") {
+		t.Error("MatchDomain matched without rules")
+	}
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// Endpoint is a server the client may connect to. Endpoints with a lower
+// Priority are preferred; endpoints sharing a Priority are ordered randomly
+// in proportion to their Weight.
+type Endpoint struct {
+	Addr     string
+	Priority int
+	Weight   int
+}
+
+func (e Endpoint) weight() int {
+	if e.Weight < 1 {
+		return 1
+	}
+	return e.Weight
+}
+
+var (
+	activeEndpoint string
+	endpointMutex  sync.Mutex
+)
+
+// GetActiveEndpoint returns the address of the endpoint currently in use.
+func GetActiveEndpoint() string {
+	endpointMutex.Lock()
+	defer endpointMutex.Unlock()
+	return activeEndpoint
+}
+
+func setActiveEndpoint(addr string) {
+	endpointMutex.Lock()
+	activeEndpoint = addr
+	endpointMutex.Unlock()
+}
+
+// ParseEndpoints parses one endpoint per line in "host:port [priority [weight]]"
+// form. Priority defaults to the position of the endpoint in the list and
+// weight to 1. Priority 0 is reserved for the primary server.
+func ParseEndpoints(text string) ([]Endpoint, error) {
+	endpoints := []Endpoint{}
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("invalid endpoint on line %d: %q", i+1, line)
+		}
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid endpoint on line %d: %v", i+1, err)
+		}
+		endpoint := Endpoint{Addr: fields[0], Priority: len(endpoints) + 1, Weight: 1}
+		if len(fields) > 1 {
+			priority, err := strconv.Atoi(fields[1])
+			if err != nil || priority < 1 {
+				return nil, fmt.Errorf("invalid priority on line %d: %q", i+1, fields[1])
+			}
+			endpoint.Priority = priority
+		}
+		if len(fields) > 2 {
+			weight, err := strconv.Atoi(fields[2])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight on line %d: %q", i+1, fields[2])
+			}
+			endpoint.Weight = weight
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// FormatEndpoints is the inverse of ParseEndpoints.
+func FormatEndpoints(endpoints []Endpoint) string {
+	lines := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		lines[i] = fmt.Sprintf("%s %d %d", e.Addr, e.Priority, e.Weight)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// endpointPool tracks failover state across connection attempts.
+type endpointPool struct {
+	sync.Mutex
+
+	endpoints []Endpoint
+	// primary is the address of the preferred endpoint, which
+	// probePrimary migrates back to
+	primary  string
+	current  int
+	failures int
+	attempts int
+}
+
+// GetEndpoints returns config.ServerAddr as the primary endpoint followed
+// by the configured fallbacks.
+func GetEndpoints(config config.Config, options IClientOptions) []Endpoint {
+	endpoints := []Endpoint{{Addr: config.ServerAddr, Priority: 0, Weight: 1}}
+	for _, e := range options.Endpoints {
+		if e.Addr != config.ServerAddr {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// newEndpointPool builds the failover order, taking a pinned endpoint or
+// auto selection into account. The primary endpoint is config.ServerAddr,
+// or the one pinned or selected.
+func newEndpointPool(config config.Config, options IClientOptions) *endpointPool {
+	endpoints := orderEndpoints(GetEndpoints(config, options))
+	endpoints = selectEndpoints(config, options, endpoints)
+	attempts := options.FailoverAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	primary := config.ServerAddr
+	if options.PinnedEndpoint != "" || options.AutoSelect {
+		primary = endpoints[0].Addr
+	}
+	pool := &endpointPool{endpoints: endpoints, primary: primary, attempts: attempts}
+	pool.current = pool.primaryIndex()
+	return pool
+}
+
+// orderEndpoints sorts endpoints by priority and shuffles those sharing a
+// priority by weight.
+func orderEndpoints(endpoints []Endpoint) []Endpoint {
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+	ordered := make([]Endpoint, 0, len(endpoints))
+	for start := 0; start < len(endpoints); {
+		end := start
+		for end < len(endpoints) && endpoints[end].Priority == endpoints[start].Priority {
+			end++
+		}
+		group := append([]Endpoint{}, endpoints[start:end]...)
+		for len(group) > 0 {
+			total := 0
+			for _, e := range group {
+				total += e.weight()
+			}
+			n := rand.Intn(total)
+			i := 0
+			for ; n >= group[i].weight(); i++ {
+				n -= group[i].weight()
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+func (p *endpointPool) Current() Endpoint {
+	p.Lock()
+	defer p.Unlock()
+	return p.endpoints[p.current]
+}
+
+func (p *endpointPool) Primary() Endpoint {
+	p.Lock()
+	defer p.Unlock()
+	return p.endpoints[p.primaryIndex()]
+}
+
+func (p *endpointPool) IsPrimary() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.endpoints[p.current].Addr == p.primary
+}
+
+func (p *endpointPool) primaryIndex() int {
+	for i, e := range p.endpoints {
+		if e.Addr == p.primary {
+			return i
+		}
+	}
+	return 0
+}
+
+// Fail records a failed connection attempt and moves on to the next
+// endpoint once the current one has failed too many times in a row.
+func (p *endpointPool) Fail() {
+	p.Lock()
+	defer p.Unlock()
+	p.failures++
+	if p.failures < p.attempts || len(p.endpoints) == 1 {
+		return
+	}
+	p.failures = 0
+	p.current = (p.current + 1) % len(p.endpoints)
+	log.Printf("Failing over to %s", p.endpoints[p.current].Addr)
+}
+
+func (p *endpointPool) Succeed() {
+	p.Lock()
+	p.failures = 0
+	p.Unlock()
+}
+
+// Reset makes the primary endpoint current again.
+func (p *endpointPool) Reset() {
+	p.Lock()
+	p.current = p.primaryIndex()
+	p.failures = 0
+	p.Unlock()
+}
+
+// probePrimary periodically checks whether the primary endpoint is
+// reachable again while connected to a fallback one, and migrates back
+// to it if so.
+func probePrimary(config config.Config, pool *endpointPool, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if pool.IsPrimary() {
+			continue
+		}
+		primary := pool.Primary()
+		conn, err := newDialer(5*time.Second).Dial("tcp", primary.Addr)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		log.Printf("Primary endpoint %s is reachable again", primary.Addr)
+		config.ServerAddr = primary.Addr
+		if err := MigrateConnection(config); err != nil {
+			log.Print(err)
+			continue
+		}
+		pool.Reset()
+		setActiveEndpoint(primary.Addr)
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		endpoints []Endpoint
+		err       bool
+	}{
+		{"empty", "", []Endpoint{}, false},
+		{"defaults", "a.example:443\nb.example:443", []Endpoint{{"a.example:443", 1, 1}, {"b.example:443", 2, 1}}, false},
+		{"blank lines", "\na.example:443\n\n  \nb.example:443\n", []Endpoint{{"a.example:443", 1, 1}, {"b.example:443", 2, 1}}, false},
+		{"priority and weight", "a.example:443 2 5\n[2001:db8::1]:443 1", []Endpoint{{"a.example:443", 2, 5}, {"[2001:db8::1]:443", 1, 1}}, false},
+		{"no port", "a.example", nil, true},
+		{"reserved priority", "a.example:443 0", nil, true},
+		{"bad priority", "a.example:443 high", nil, true},
+		{"bad weight", "a.example:443 1 0", nil, true},
+		{"extra field", "a.example:443 1 1 1", nil, true},
+	}
+	for _, tt := range tests {
+		endpoints, err := ParseEndpoints(tt.text)
+		if (err != nil) != tt.err || !tt.err && !reflect.DeepEqual(endpoints, tt.endpoints) {
+			t.Errorf("%s: ParseEndpoints = %v, %v, want %v", tt.name, endpoints, err, tt.endpoints)
+		}
+		if err == nil {
+			if again, _ := ParseEndpoints(FormatEndpoints(endpoints)); !reflect.DeepEqual(again, endpoints) {
+				t.Errorf("%s: FormatEndpoints doesn't round-trip: %v", tt.name, again)
+			}
+		}
+	}
+}
+
+func TestEndpointPoolFailover(t *testing.T) {
+	c := config.Config{ServerAddr: "primary.example:443"}
+	options := DefaultOptions
+	options.FailoverAttempts = 2
+	options.Endpoints = []Endpoint{{"second.example:443", 2, 1}, {"first.example:443", 1, 1}}
+	pool := newEndpointPool(c, options)
+
+	steps := []struct {
+		action  func()
+		current string
+		primary bool
+	}{
+		{func() {}, "primary.example:443", true},
+		{pool.Fail, "primary.example:443", true},
+		{pool.Fail, "first.example:443", false},
+		{pool.Succeed, "first.example:443", false},
+		{pool.Fail, "first.example:443", false},
+		{pool.Fail, "second.example:443", false},
+		{pool.Reset, "primary.example:443", true},
+	}
+	for i, step := range steps {
+		step.action()
+		if current := pool.Current().Addr; current != step.current || pool.IsPrimary() != step.primary {
+			t.Errorf("step %d: current %s, primary %v, want %s, %v", i, current, pool.IsPrimary(), step.current, step.primary)
+		}
+	}
+	if primary := pool.Primary().Addr; primary != c.ServerAddr {
+		t.Errorf("Primary = %s, want %s", primary, c.ServerAddr)
+	}
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Profiles are shared as bundles holding the server, key, TLS and routing
+// settings. The device identity is left out: whoever imports a bundle
+// registers a device of their own.
+
+// ProfileURIScheme prefixes a profile bundle encoded as a single link.
+const ProfileURIScheme = "xtun://"
+
+// ProfileKDFIterations is the PBKDF2 iteration count of new encrypted
+// bundles.
+var ProfileKDFIterations = 600000
+
+var errPassphraseRequired = errors.New("the profile is encrypted, a passphrase is required")
+
+// ProfileBundle is the shareable part of a profile.
+type ProfileBundle struct {
+	Name               string     `json:"name" yaml:"name"`
+	Server             string     `json:"server" yaml:"server"`
+	Key                string     `json:"key" yaml:"key"`
+	Protocol           string     `json:"protocol" yaml:"protocol"`
+	InsecureSkipVerify bool       `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+	Endpoints          []Endpoint `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	IncludeRoutes      []string   `json:"includeRoutes,omitempty" yaml:"includeRoutes,omitempty"`
+	ExcludeRoutes      []string   `json:"excludeRoutes,omitempty" yaml:"excludeRoutes,omitempty"`
+	DomainRoutes       []string   `json:"domainRoutes,omitempty" yaml:"domainRoutes,omitempty"`
+	AcceptServerRoutes bool       `json:"acceptServerRoutes" yaml:"acceptServerRoutes"`
+	ApplyDNS           bool       `json:"applyDNS" yaml:"applyDNS"`
+}
+
+// profileEnvelope is the encoded form of a bundle, either in clear or
+// encrypted with a passphrase.
+type profileEnvelope struct {
+	Version   int            `json:"version" yaml:"version"`
+	Profile   *ProfileBundle `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Encrypted *sealedBundle  `json:"encrypted,omitempty" yaml:"encrypted,omitempty"`
+}
+
+// sealedBundle is a bundle encrypted with AES-256-GCM under a key derived
+// from the passphrase with PBKDF2-HMAC-SHA256.
+type sealedBundle struct {
+	KDF        string `json:"kdf" yaml:"kdf"`
+	Iterations int    `json:"iterations" yaml:"iterations"`
+	Salt       string `json:"salt" yaml:"salt"`
+	Nonce      string `json:"nonce" yaml:"nonce"`
+	Data       string `json:"data" yaml:"data"`
+}
+
+// ExportProfile returns the bundle of a saved profile.
+func ExportProfile(name string) (ProfileBundle, error) {
+	c, options, err := LoadProfile(name)
+	if err != nil {
+		return ProfileBundle{}, err
+	}
+	return ProfileBundle{
+		Name:               name,
+		Server:             c.ServerAddr,
+		Key:                c.Key,
+		Protocol:           c.Protocol,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		Endpoints:          options.Endpoints,
+		IncludeRoutes:      options.IncludeRoutes,
+		ExcludeRoutes:      options.ExcludeRoutes,
+		DomainRoutes:       options.DomainRoutes,
+		AcceptServerRoutes: options.AcceptServerRoutes,
+		ApplyDNS:           options.ApplyDNS,
+	}, nil
+}
+
+// EncodeProfileURI encodes a bundle as an xtun:// link, encrypted if
+// passphrase isn't empty.
+func EncodeProfileURI(b ProfileBundle, passphrase string) (string, error) {
+	envelope, err := sealProfile(b, passphrase)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return ProfileURIScheme + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// EncodeProfileFile encodes a bundle as a JSON or, if yamlFormat is set,
+// YAML file, encrypted if passphrase isn't empty.
+func EncodeProfileFile(b ProfileBundle, passphrase string, yamlFormat bool) ([]byte, error) {
+	envelope, err := sealProfile(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if yamlFormat {
+		return yaml.Marshal(envelope)
+	}
+	return json.MarshalIndent(envelope, "", " ")
+}
+
+// IsProfileEncrypted reports whether data, a link or a file, holds an
+// encrypted bundle.
+func IsProfileEncrypted(data []byte) bool {
+	envelope, err := parseEnvelope(data)
+	return err == nil && envelope.Encrypted != nil
+}
+
+// DecodeProfile decodes and validates a bundle from a link or a JSON or
+// YAML file. passphrase is only needed for encrypted bundles.
+func DecodeProfile(data []byte, passphrase string) (ProfileBundle, error) {
+	envelope, err := parseEnvelope(data)
+	if err != nil {
+		return ProfileBundle{}, err
+	}
+	if envelope.Version != 1 {
+		return ProfileBundle{}, fmt.Errorf("unsupported profile version %d", envelope.Version)
+	}
+	var b ProfileBundle
+	switch {
+	case envelope.Encrypted != nil:
+		if passphrase == "" {
+			return ProfileBundle{}, errPassphraseRequired
+		}
+		plain, err := envelope.Encrypted.open(passphrase)
+		if err != nil {
+			return ProfileBundle{}, err
+		}
+		if err := json.Unmarshal(plain, &b); err != nil {
+			return ProfileBundle{}, err
+		}
+	case envelope.Profile != nil:
+		b = *envelope.Profile
+	default:
+		return ProfileBundle{}, errors.New("no profile found")
+	}
+	if err := ValidateProfileBundle(b); err != nil {
+		return ProfileBundle{}, err
+	}
+	return b, nil
+}
+
+func parseEnvelope(data []byte) (profileEnvelope, error) {
+	var envelope profileEnvelope
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte(ProfileURIScheme)) {
+		decoded, err := base64.RawURLEncoding.DecodeString(string(data[len(ProfileURIScheme):]))
+		if err != nil {
+			return envelope, fmt.Errorf("invalid profile link: %v", err)
+		}
+		data = decoded
+	}
+	if bytes.HasPrefix(data, []byte("{")) {
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return envelope, fmt.Errorf("invalid profile: %v", err)
+		}
+		return envelope, nil
+	}
+	if err := yaml.Unmarshal(data, &envelope); err != nil {
+		return envelope, fmt.Errorf("invalid profile: %v", err)
+	}
+	return envelope, nil
+}
+
+var domainRuleRegexp = regexp.MustCompile(`^(\*\.)?([A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?\.?$`)
+
+// ValidateProfileBundle checks every setting of a bundle.
+func ValidateProfileBundle(b ProfileBundle) error {
+	if err := CheckProfileName(b.Name); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(b.Server); err != nil {
+		return fmt.Errorf("invalid server address: %v", err)
+	}
+	if b.Protocol != "ws" && b.Protocol != "wss" {
+		return fmt.Errorf("invalid protocol %q", b.Protocol)
+	}
+	for _, e := range b.Endpoints {
+		if _, _, err := net.SplitHostPort(e.Addr); err != nil {
+			return fmt.Errorf("invalid endpoint: %v", err)
+		}
+		if e.Priority < 1 || e.Weight < 1 {
+			return fmt.Errorf("invalid priority or weight of endpoint %s", e.Addr)
+		}
+	}
+	if _, err := ParsePrefixes(b.IncludeRoutes); err != nil {
+		return err
+	}
+	if _, err := ParsePrefixes(b.ExcludeRoutes); err != nil {
+		return err
+	}
+	for _, d := range b.DomainRoutes {
+		if !domainRuleRegexp.MatchString(d) {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	return nil
+}
+
+// ProfileBundleWarnings returns the settings of a bundle that weaken the
+// security of the connection, which the user must accept before it is
+// imported.
+func ProfileBundleWarnings(b ProfileBundle) []string {
+	warnings := []string{}
+	if b.Protocol == "ws" {
+		warnings = append(warnings, "the connection to the server is not encrypted (ws)")
+	}
+	if b.InsecureSkipVerify {
+		warnings = append(warnings, "the server certificate is not verified")
+	}
+	return warnings
+}
+
+// ImportProfile registers a device with the server of a bundle and saves
+// it as a new profile, named name or, if empty, as in the bundle. A bundle
+// with ProfileBundleWarnings is only imported if allowInsecure is set.
+func ImportProfile(b ProfileBundle, name string, allowInsecure bool) (string, error) {
+	if name != "" {
+		b.Name = name
+	}
+	if err := ValidateProfileBundle(b); err != nil {
+		return "", err
+	}
+	if warnings := ProfileBundleWarnings(b); len(warnings) > 0 && !allowInsecure {
+		return "", fmt.Errorf("refusing insecure profile %s: %s", b.Name, strings.Join(warnings, ", "))
+	}
+	if _, err := os.Stat(profileDir(b.Name)); err == nil {
+		return "", fmt.Errorf("profile %s already exists", b.Name)
+	}
+	c := DefaultConfig()
+	options := DefaultOptions
+	applyProfileBundle(&c, &options, b)
+	if err := SyncServerSettings(&c, &options); err != nil {
+		return "", err
+	}
+	if err := RegisterDevice(&c, &options); err != nil {
+		return "", err
+	}
+	return b.Name, SaveProfile(b.Name, c, options)
+}
+
+// applyProfileBundle copies the settings of a bundle into c and options.
+func applyProfileBundle(c *config.Config, options *IClientOptions, b ProfileBundle) {
+	c.ServerAddr = b.Server
+	c.Key = b.Key
+	c.Protocol = b.Protocol
+	c.InsecureSkipVerify = b.InsecureSkipVerify
+	options.Endpoints = b.Endpoints
+	options.IncludeRoutes = b.IncludeRoutes
+	options.ExcludeRoutes = b.ExcludeRoutes
+	options.DomainRoutes = b.DomainRoutes
+	options.AcceptServerRoutes = b.AcceptServerRoutes
+	options.ApplyDNS = b.ApplyDNS
+}
+
+func sealProfile(b ProfileBundle, passphrase string) (profileEnvelope, error) {
+	if passphrase == "" {
+		return profileEnvelope{Version: 1, Profile: &b}, nil
+	}
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return profileEnvelope{}, err
+	}
+	salt := make([]byte, 16)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(salt); err != nil {
+		return profileEnvelope{}, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return profileEnvelope{}, err
+	}
+	aead, err := profileAEAD(passphrase, salt, ProfileKDFIterations)
+	if err != nil {
+		return profileEnvelope{}, err
+	}
+	sealed := &sealedBundle{
+		KDF:        "pbkdf2-sha256",
+		Iterations: ProfileKDFIterations,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Data:       base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plain, nil)),
+	}
+	return profileEnvelope{Version: 1, Encrypted: sealed}, nil
+}
+
+func (s *sealedBundle) open(passphrase string) ([]byte, error) {
+	if s.KDF != "pbkdf2-sha256" || s.Iterations < 1 || s.Iterations > 10000000 {
+		return nil, fmt.Errorf("unsupported key derivation %s", s.KDF)
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(s.Salt)
+	nonce, err2 := base64.StdEncoding.DecodeString(s.Nonce)
+	data, err3 := base64.StdEncoding.DecodeString(s.Data)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, fmt.Errorf("invalid encrypted profile: %v", err)
+	}
+	aead, err := profileAEAD(passphrase, salt, s.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid encrypted profile")
+	}
+	plain, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted profile")
+	}
+	return plain, nil
+}
+
+func profileAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ProfileFileIsYAML reports whether a file name asks for the YAML format.
+func ProfileFileIsYAML(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".yaml") || strings.HasSuffix(lower, ".yml")
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testBundle() ProfileBundle {
+	return ProfileBundle{
+		Name:               "office",
+		Server:             "vpn.example.com:443",
+		Key:                "secret",
+		Protocol:           "wss",
+		Endpoints:          []Endpoint{{Addr: "vpn2.example.com:443", Priority: 1, Weight: 1}},
+		IncludeRoutes:      []string{"10.0.0.0/8"},
+		ExcludeRoutes:      []string{"10.1.0.0/16"},
+		DomainRoutes:       []string{"internal.corp", "*.git.example"},
+		AcceptServerRoutes: true,
+		ApplyDNS:           true,
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	iterations := ProfileKDFIterations
+	ProfileKDFIterations = 1000
+	defer func() { ProfileKDFIterations = iterations }()
+
+	b := testBundle()
+	tests := []struct {
+		name       string
+		passphrase string
+		encode     func(ProfileBundle, string) ([]byte, error)
+	}{
+		{"link", "", func(b ProfileBundle, p string) ([]byte, error) {
+			s, err := EncodeProfileURI(b, p)
+			return []byte(s), err
+		}},
+		{"encrypted link", "correct horse", func(b ProfileBundle, p string) ([]byte, error) {
+			s, err := EncodeProfileURI(b, p)
+			return []byte(s), err
+		}},
+		{"json", "", func(b ProfileBundle, p string) ([]byte, error) { return EncodeProfileFile(b, p, false) }},
+		{"encrypted json", "correct horse", func(b ProfileBundle, p string) ([]byte, error) { return EncodeProfileFile(b, p, false) }},
+		{"yaml", "", func(b ProfileBundle, p string) ([]byte, error) { return EncodeProfileFile(b, p, true) }},
+		{"encrypted yaml", "correct horse", func(b ProfileBundle, p string) ([]byte, error) { return EncodeProfileFile(b, p, true) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.encode(b, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted := IsProfileEncrypted(data); encrypted != (tt.passphrase != "") {
+				t.Errorf("IsProfileEncrypted = %v", encrypted)
+			}
+			if tt.passphrase != "" && strings.Contains(string(data), b.Key) {
+				t.Error("the encrypted profile holds the key in clear")
+			}
+			got, err := DecodeProfile(data, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, b) {
+				t.Errorf("DecodeProfile = %+v, want %+v", got, b)
+			}
+		})
+	}
+}
+
+func TestDecodeProfilePassphrase(t *testing.T) {
+	iterations := ProfileKDFIterations
+	ProfileKDFIterations = 1000
+	defer func() { ProfileKDFIterations = iterations }()
+
+	data, err := EncodeProfileFile(testBundle(), "correct horse", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		passphrase string
+		err        string
+	}{
+		{"", errPassphraseRequired.Error()},
+		{"wrong horse", "wrong passphrase"},
+		{"correct horse", ""},
+	}
+	for _, tt := range tests {
+		_, err := DecodeProfile(data, tt.passphrase)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("DecodeProfile(%q) = %v, want %q", tt.passphrase, err, tt.err)
+		}
+	}
+}
+
+// A bundle sealed by an earlier release, which must stay readable.
+func TestDecodeProfileSealed(t *testing.T) {
+	data := `{"version":1,"encrypted":{"kdf":"pbkdf2-sha256","iterations":1000,"salt":"m7dBcg/R0O4wphXCQzydKg==","nonce":"JhF/IDElQfQNls3F","data":"uYdE3Up0Mj01lc19gJrs+t6UXIiMfU3hT0CwrtKntl8/XpmpZ3eMpviWn702Hsh3NNSo7bGVgZ/OPv+bRFeQUQCY75Jpif5gOPWltVlRLH7uDTCxR7Xp4dDqXmCD95HBh2kcG8YxnyV15lKXxmqn/l7mF6y4hs7twrlS9bPJCDi5mAxwP0m4Wmj7bEWwtxy2cAxnj7cTasr7WH8VkjRObDLa"}}`
+	b, err := DecodeProfile([]byte(data), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ProfileBundle{Name: "office", Server: "vpn.example.com:443", Key: "k", Protocol: "wss"}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("DecodeProfile = %+v, want %+v", b, want)
+	}
+}
+
+func TestValidateProfileBundle(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*ProfileBundle)
+		err    string
+	}{
+		{"valid", func(b *ProfileBundle) {}, ""},
+		{"name", func(b *ProfileBundle) { b.Name = "../office" }, "invalid profile name"},
+		{"server", func(b *ProfileBundle) { b.Server = "vpn.example.com" }, "invalid server address"},
+		{"protocol", func(b *ProfileBundle) { b.Protocol = "http" }, "invalid protocol"},
+		{"endpoint", func(b *ProfileBundle) { b.Endpoints[0].Addr = "vpn2.example.com" }, "invalid endpoint"},
+		{"priority", func(b *ProfileBundle) { b.Endpoints[0].Priority = 0 }, "invalid priority"},
+		{"weight", func(b *ProfileBundle) { b.Endpoints[0].Weight = 0 }, "invalid priority or weight"},
+		{"include", func(b *ProfileBundle) { b.IncludeRoutes = []string{"10.0.0.1/8"} }, "host bits set"},
+		{"exclude", func(b *ProfileBundle) { b.ExcludeRoutes = []string{"10.1.0.0/16", "10.1.2.0/24"} }, "overlaps"},
+		{"domain", func(b *ProfileBundle) { b.DomainRoutes = []string{"bad domain"} }, "invalid domain"},
+		{"wildcard", func(b *ProfileBundle) { b.DomainRoutes = []string{"a.*.example"} }, "invalid domain"},
+	}
+	for _, tt := range tests {
+		b := testBundle()
+		tt.modify(&b)
+		err := ValidateProfileBundle(b)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: ValidateProfileBundle = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestProfileBundleWarnings(t *testing.T) {
+	tests := []struct {
+		protocol string
+		insecure bool
+		warnings int
+	}{
+		{"wss", false, 0},
+		{"ws", false, 1},
+		{"wss", true, 1},
+		{"ws", true, 2},
+	}
+	for _, tt := range tests {
+		b := testBundle()
+		b.Protocol, b.InsecureSkipVerify = tt.protocol, tt.insecure
+		if warnings := ProfileBundleWarnings(b); len(warnings) != tt.warnings {
+			t.Errorf("ProfileBundleWarnings(%s, %v) = %q, want %d warnings", tt.protocol, tt.insecure, warnings, tt.warnings)
+		}
+	}
+}
+
+// Insecure bundles are refused before the profile directory or the server
+// are touched.
+func TestImportProfileInsecure(t *testing.T) {
+	root := profilesRoot
+	profilesRoot = t.TempDir()
+	defer func() { profilesRoot = root }()
+
+	tests := []struct {
+		protocol string
+		insecure bool
+	}{
+		{"ws", false},
+		{"wss", true},
+	}
+	for _, tt := range tests {
+		b := testBundle()
+		b.Protocol, b.InsecureSkipVerify = tt.protocol, tt.insecure
+		_, err := ImportProfile(b, "", false)
+		if err == nil || !strings.Contains(err.Error(), "refusing insecure profile") {
+			t.Errorf("ImportProfile(%s, %v) = %v, want a refusal", tt.protocol, tt.insecure, err)
+		}
+	}
+}
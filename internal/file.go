@@ -2,9 +2,13 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/xorgal/xtun-core/pkg/config"
 )
@@ -16,15 +20,19 @@ type IDirPath struct {
 }
 
 type IFilePath struct {
-	BinaryPath string
-	ConfigPath string
-	StatePath  string
-	PidPath    string
+	BinaryPath  string
+	ConfigPath  string
+	StatePath   string
+	OptionsPath string
+	JournalPath string
+	PidPath     string
 }
 
 var BinaryFile = "xtun.exe"
 var ConfigFile = "config.json"
 var StateFile = "state.json"
+var OptionsFile = "options.json"
+var JournalFile = "journal.json"
 var PidFile = ".xtun.pid"
 
 var DirPath = IDirPath{
@@ -34,10 +42,12 @@ var DirPath = IDirPath{
 }
 
 var FilePath = IFilePath{
-	BinaryPath: fmt.Sprintf("%s/%s", DirPath.BinaryDir, BinaryFile),
-	ConfigPath: fmt.Sprintf("%s/%s", DirPath.AppDataDir, ConfigFile),
-	StatePath:  fmt.Sprintf("%s/%s", DirPath.AppDataDir, StateFile),
-	PidPath:    fmt.Sprintf("%s/%s", DirPath.TempDir, PidFile),
+	BinaryPath:  fmt.Sprintf("%s/%s", DirPath.BinaryDir, BinaryFile),
+	ConfigPath:  fmt.Sprintf("%s/%s", DirPath.AppDataDir, ConfigFile),
+	StatePath:   fmt.Sprintf("%s/%s", DirPath.AppDataDir, StateFile),
+	OptionsPath: fmt.Sprintf("%s/%s", DirPath.AppDataDir, OptionsFile),
+	JournalPath: fmt.Sprintf("%s/%s", DirPath.AppDataDir, JournalFile),
+	PidPath:     fmt.Sprintf("%s/%s", DirPath.TempDir, PidFile),
 }
 
 func SaveConfigFile(config config.Config) error {
@@ -102,7 +112,7 @@ func LoadStateFile() error {
 }
 
 func IsStateFileExists() bool {
-	if _, err := os.Stat(FilePath.ConfigPath); err != nil {
+	if _, err := os.Stat(FilePath.StatePath); err != nil {
 		if os.IsNotExist(err) {
 			return false
 		} else {
@@ -114,11 +124,80 @@ func IsStateFileExists() bool {
 	}
 }
 
+func SaveOptionsFile(options IClientOptions) error {
+	file, err := json.MarshalIndent(options, "", " ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(FilePath.OptionsPath, file, 0644)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func LoadOptionsFile() error {
+	file, err := os.ReadFile(FilePath.OptionsPath)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(file, &ClientOptions)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func IsOptionsFileExists() bool {
+	if _, err := os.Stat(FilePath.OptionsPath); err != nil {
+		if os.IsNotExist(err) {
+			return false
+		} else {
+			log.Printf("error reading %s: %v", FilePath.OptionsPath, err)
+			return false
+		}
+	} else {
+		return true
+	}
+}
+
+// SavePidFile records the pid of this process, replacing the pid file of
+// a process that is gone, e.g. after a crash.
 func SavePidFile() error {
-	_, err := os.OpenFile(FilePath.PidPath, os.O_CREATE|os.O_EXCL, 0666)
+	if _, err := os.Stat(FilePath.PidPath); err == nil && !IsPidFileActive() {
+		log.Printf("Removing stale pid file %s", FilePath.PidPath)
+		os.Remove(FilePath.PidPath)
+	}
+	file, err := os.OpenFile(FilePath.PidPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
 	return err
 }
 
+// IsPidFileActive reports whether the pid file exists and the process it
+// records is running. Pid files of versions that didn't record the pid are
+// considered stale.
+func IsPidFileActive() bool {
+	data, err := os.ReadFile(FilePath.PidPath)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks that the process exists
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone)
+}
+
 func RmPidFile() error {
 	err := os.Remove(FilePath.PidPath)
 	return err
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+)
+
+// UDPForwardTimeout is how long a UDP forward session stays open without
+// traffic.
+var UDPForwardTimeout = 60 * time.Second
+
+// Forward makes Remote, an address reached through the tunnel, available
+// on the local address Local, like ssh -L.
+type Forward struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string
+	Local    string
+	Remote   string
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.Protocol, f.Local, f.Remote)
+}
+
+// ParseForwards parses one forward per line in "local remote [tcp|udp]"
+// form. A local address without host is bound to loopback, e.g.
+// "5432 10.8.0.5:5432".
+func ParseForwards(text string) ([]Forward, error) {
+	forwards := []Forward{}
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid forward on line %d: %q", i+1, line)
+		}
+		f := Forward{Protocol: "tcp", Local: fields[0], Remote: fields[1]}
+		if !strings.Contains(f.Local, ":") {
+			f.Local = net.JoinHostPort("127.0.0.1", f.Local)
+		}
+		if len(fields) > 2 {
+			f.Protocol = strings.ToLower(fields[2])
+		}
+		if f.Protocol != "tcp" && f.Protocol != "udp" {
+			return nil, fmt.Errorf("invalid protocol on line %d: %q", i+1, fields[2])
+		}
+		for _, addr := range []string{f.Local, f.Remote} {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid forward on line %d: %v", i+1, err)
+			}
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// FormatForwards is the inverse of ParseForwards.
+func FormatForwards(forwards []Forward) string {
+	lines := make([]string, len(forwards))
+	for i, f := range forwards {
+		lines[i] = fmt.Sprintf("%s %s %s", f.Local, f.Remote, f.Protocol)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ForwardStats describes the traffic of a forward.
+type ForwardStats struct {
+	Forward
+	// Active is the number of open connections, or UDP sessions
+	Active int64
+	// Total is the number of connections since the forward started
+	Total int64
+	// Sent and Received count the bytes to and from Remote
+	Sent     int64
+	Received int64
+	// Err is set if the forward failed to start
+	Err error
+}
+
+// GetForwardStats returns the stats of the running forwards.
+func GetForwardStats() []ForwardStats {
+	v, ok := cache.GetCache().Get("forwards")
+	if !ok {
+		return nil
+	}
+	stats := []ForwardStats{}
+	for _, f := range v.(*forwardSet).forwarders {
+		stats = append(stats, f.stats())
+	}
+	return stats
+}
+
+// forwardSet runs the forwards of a session.
+type forwardSet struct {
+	forwarders []*forwarder
+}
+
+// startForwards starts forwards dialing through dialer. A forward that
+// can't listen is reported in its stats and doesn't stop the others.
+func startForwards(dialer contextDialer, forwards []Forward) *forwardSet {
+	s := &forwardSet{}
+	for _, f := range forwards {
+		fw := &forwarder{forward: f, dialer: dialer, conns: map[net.Conn]bool{}}
+		if err := fw.start(); err != nil {
+			log.Printf("forward %s: %v", f, err)
+			fw.err = err
+		}
+		s.forwarders = append(s.forwarders, fw)
+	}
+	return s
+}
+
+func (s *forwardSet) Close() {
+	for _, f := range s.forwarders {
+		f.Close()
+	}
+}
+
+type forwarder struct {
+	sync.Mutex
+
+	forward  Forward
+	dialer   contextDialer
+	listener net.Listener
+	packets  net.PacketConn
+	conns    map[net.Conn]bool
+	err      error
+
+	active   atomic.Int64
+	total    atomic.Int64
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (f *forwarder) start() error {
+	if f.forward.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp", f.forward.Local)
+		if err != nil {
+			return err
+		}
+		f.packets = conn
+		go f.serveUDP()
+	} else {
+		l, err := net.Listen("tcp", f.forward.Local)
+		if err != nil {
+			return err
+		}
+		f.listener = l
+		go f.serveTCP()
+	}
+	log.Printf("Forwarding %s", f.forward)
+	return nil
+}
+
+func (f *forwarder) stats() ForwardStats {
+	return ForwardStats{
+		Forward:  f.forward,
+		Active:   f.active.Load(),
+		Total:    f.total.Load(),
+		Sent:     f.sent.Load(),
+		Received: f.received.Load(),
+		Err:      f.err,
+	}
+}
+
+func (f *forwarder) dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return f.dialer.DialContext(ctx, f.forward.Protocol, f.forward.Remote)
+}
+
+// track records conn as open, or forgets it, so that Close can close it.
+func (f *forwarder) track(conn net.Conn, open bool) {
+	f.Lock()
+	defer f.Unlock()
+	if open {
+		f.conns[conn] = true
+		f.active.Add(1)
+		f.total.Add(1)
+	} else if f.conns[conn] {
+		delete(f.conns, conn)
+		f.active.Add(-1)
+	}
+}
+
+func (f *forwarder) serveTCP() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := f.dial()
+			if err != nil {
+				log.Printf("forward %s: %v", f.forward, err)
+				return
+			}
+			defer remote.Close()
+			f.track(conn, true)
+			defer f.track(conn, false)
+			relay(conn, &countingConn{Conn: remote, written: &f.sent, read: &f.received})
+		}()
+	}
+}
+
+// udpQueueSize is how many datagrams of a UDP session are queued while
+// Remote is being dialed. Further ones are dropped.
+const udpQueueSize = 64
+
+// udpSession is the connection of a local UDP client to Remote.
+type udpSession struct {
+	packets chan []byte
+	done    chan struct{}
+}
+
+// serveUDP relays datagrams from each local client through its own
+// connection to Remote, so that replies find their way back. Sessions are
+// dialed in the background, so that a slow dial only delays its client.
+func (f *forwarder) serveUDP() {
+	sessions := map[string]*udpSession{}
+	var mutex sync.Mutex
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := f.packets.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := client.String()
+		mutex.Lock()
+		session := sessions[key]
+		if session == nil {
+			session = &udpSession{packets: make(chan []byte, udpQueueSize), done: make(chan struct{})}
+			sessions[key] = session
+			go func() {
+				f.runUDPSession(session, client)
+				mutex.Lock()
+				delete(sessions, key)
+				mutex.Unlock()
+			}()
+		}
+		select {
+		case session.packets <- append([]byte{}, buf[:n]...):
+		default:
+		}
+		mutex.Unlock()
+	}
+}
+
+// runUDPSession dials Remote for client and relays its datagrams until
+// the session times out.
+func (f *forwarder) runUDPSession(session *udpSession, client net.Addr) {
+	remote, err := f.dial()
+	if err != nil {
+		log.Printf("forward %s: %v", f.forward, err)
+		return
+	}
+	defer remote.Close()
+	f.track(remote, true)
+	defer f.track(remote, false)
+	go func() {
+		f.udpReplies(remote, client)
+		close(session.done)
+	}()
+	for {
+		select {
+		case packet := <-session.packets:
+			remote.SetReadDeadline(time.Now().Add(UDPForwardTimeout))
+			if _, err := remote.Write(packet); err == nil {
+				f.sent.Add(int64(len(packet)))
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (f *forwarder) udpReplies(remote net.Conn, client net.Addr) {
+	buf := make([]byte, 65535)
+	for {
+		remote.SetReadDeadline(time.Now().Add(UDPForwardTimeout))
+		n, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		f.received.Add(int64(n))
+		if _, err := f.packets.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+func (f *forwarder) Close() {
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.packets != nil {
+		f.packets.Close()
+	}
+	f.Lock()
+	defer f.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// countingConn adds the bytes read from and written to a connection to
+// counters.
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+	read    *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseForwards(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		forwards []Forward
+		err      bool
+	}{
+		{"empty", "\n \n", []Forward{}, false},
+		{"port only", "5432 10.8.0.5:5432", []Forward{{"tcp", "127.0.0.1:5432", "10.8.0.5:5432"}}, false},
+		{"udp", "0.0.0.0:53 10.8.0.1:53 UDP", []Forward{{"udp", "0.0.0.0:53", "10.8.0.1:53"}}, false},
+		{"ipv6", "[::1]:8080 [fd00::5]:80 tcp", []Forward{{"tcp", "[::1]:8080", "[fd00::5]:80"}}, false},
+		{"several", "80 10.8.0.5:80\n\n443 10.8.0.5:443", []Forward{{"tcp", "127.0.0.1:80", "10.8.0.5:80"}, {"tcp", "127.0.0.1:443", "10.8.0.5:443"}}, false},
+		{"missing remote", "5432", nil, true},
+		{"remote without port", "5432 10.8.0.5", nil, true},
+		{"bad protocol", "5432 10.8.0.5:5432 sctp", nil, true},
+		{"extra field", "5432 10.8.0.5:5432 tcp x", nil, true},
+	}
+	for _, tt := range tests {
+		forwards, err := ParseForwards(tt.text)
+		if (err != nil) != tt.err || !tt.err && !reflect.DeepEqual(forwards, tt.forwards) {
+			t.Errorf("%s: ParseForwards = %v, %v, want %v", tt.name, forwards, err, tt.forwards)
+		}
+		if err == nil {
+			if again, _ := ParseForwards(FormatForwards(forwards)); !reflect.DeepEqual(again, forwards) {
+				t.Errorf("%s: FormatForwards doesn't round-trip: %v", tt.name, again)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtun-core/pkg/netutil"
+)
+
+// Every address of every server endpoint gets a host route via the
+// current gateway of the physical network, so that the connection to the
+// server never ends up in the tunnel once the default route points to it.
+
+var (
+	localGateway string
+	gatewayMutex sync.Mutex
+	pinMutex     sync.Mutex
+)
+
+// discoverGateways looks up the current IPv4 and IPv6 gateways, which may
+// have changed since setup, and stores them in config and ClientOptions.
+// The previous ones are kept if discovery fails.
+func discoverGateways(config *config.Config) {
+	if gw, err := netutil.DiscoverGateway(true); err == nil && gw != nil {
+		config.LocalGateway = gw.String()
+	} else {
+		log.Printf("unable to discover the IPv4 gateway, using %s", config.LocalGateway)
+	}
+	if gw, err := netutil.DiscoverGateway(false); err == nil && gw != nil {
+		ClientOptions.LocalGatewayV6 = gw.String()
+		if dev, err := gatewayDev(ClientOptions.LocalGatewayV6); err == nil {
+			ClientOptions.LocalGatewayV6Dev = dev
+		} else if routesSupported {
+			log.Printf("unable to find the interface of the IPv6 gateway: %v", err)
+		}
+	}
+	gatewayMutex.Lock()
+	localGateway = config.LocalGateway
+	gatewayMutex.Unlock()
+}
+
+// getLocalGateway returns the IPv4 gateway found by the last discovery.
+func getLocalGateway() string {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+	return localGateway
+}
+
+// planServerRoutes returns a host route for each of ips via the gateway of
+// its address family, IPv6 ones through gatewayV6Dev as the gateway is
+// usually link-local. Addresses of a family without a gateway are not
+// reachable anyway and are skipped.
+func planServerRoutes(ips []net.IP, gateway, gatewayV6, gatewayV6Dev string) ([]Route, error) {
+	routes := []Route{}
+	seen := map[netip.Addr]bool{}
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		route := Route{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Gateway: gateway}
+		if addr.Is6() {
+			route.Gateway, route.Dev = gatewayV6, gatewayV6Dev
+		}
+		if route.Gateway == "" {
+			log.Printf("no local gateway for server address %s", addr)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no local gateway to reach the server")
+	}
+	return routes, nil
+}
+
+// pinServerRoutes installs the host routes to the server endpoints,
+// replacing the ones installed before if the addresses or gateways have
+// changed. Marked sockets bypass the tunnel with policy routing and the
+// userspace stack leaves the routes alone, so no routes are needed then.
+// Where the client can't manage routes, xtun-core routes the server.
+func pinServerRoutes(config config.Config) error {
+	if ClientOptions.PolicyRouting || ClientOptions.UserspaceStack || !routesSupported {
+		return nil
+	}
+	pinMutex.Lock()
+	defer pinMutex.Unlock()
+	ips, err := resolveEndpoints(config, ClientOptions)
+	if err != nil {
+		return err
+	}
+	routes, err := planServerRoutes(ips, config.LocalGateway, ClientOptions.LocalGatewayV6, ClientOptions.LocalGatewayV6Dev)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(routes, getServerRoutes()) {
+		return nil
+	}
+	unpinServerRoutes()
+	installed := []Route{}
+	for _, r := range routes {
+		if err := applyRoute(r); err != nil {
+			for _, r := range installed {
+				revertRoute(r)
+			}
+			return fmt.Errorf("unable to route server address %s via %s: %w", r.Prefix.Addr(), r.Gateway, err)
+		}
+		installed = append(installed, r)
+	}
+	cache.GetCache().Set("serverroutes", installed, 24*time.Hour)
+	return nil
+}
+
+func getServerRoutes() []Route {
+	if v, ok := cache.GetCache().Get("serverroutes"); ok {
+		return v.([]Route)
+	}
+	return nil
+}
+
+// unpinServerRoutes removes the routes added by pinServerRoutes.
+func unpinServerRoutes() {
+	for _, r := range getServerRoutes() {
+		if err := revertRoute(r); err != nil {
+			log.Print(err)
+		}
+	}
+	cache.GetCache().Delete("serverroutes")
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtun-core/pkg/tun"
+)
+
+// The journal records every network change the client makes before it is
+// applied, and forgets it once undone. A journal left behind by a crashed
+// client is replayed in reverse by RepairNetwork to restore the original
+// network configuration.
+
+const (
+	JournalRoute = "route"
+	JournalRule  = "rule"
+	JournalTable = "table"
+	JournalTun   = "tun"
+	JournalDNS   = "dns"
+	// JournalKillSwitch is removed on repair so the user isn't locked out
+	JournalKillSwitch = "killswitch"
+	JournalDNSBlock   = "dnsblock"
+)
+
+type JournalEntry struct {
+	Kind   string
+	Route  *Route         `json:",omitempty"`
+	Rule   *policyRule    `json:",omitempty"`
+	Table  int            `json:",omitempty"`
+	Config *config.Config `json:",omitempty"`
+	DNS    *dnsBackup     `json:",omitempty"`
+}
+
+var (
+	journal      []JournalEntry
+	journalMutex sync.Mutex
+)
+
+// journalRecord persists e before the change it describes is applied.
+func journalRecord(e JournalEntry) {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	journal = append(journal, e)
+	if err := saveJournal(); err != nil {
+		log.Print(err)
+	}
+}
+
+// journalForget drops e once the change it describes has been undone.
+func journalForget(e JournalEntry) {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	for i := len(journal) - 1; i >= 0; i-- {
+		if reflect.DeepEqual(journal[i], e) {
+			journal = append(journal[:i], journal[i+1:]...)
+			break
+		}
+	}
+	if err := saveJournal(); err != nil {
+		log.Print(err)
+	}
+}
+
+// saveJournal atomically rewrites the journal file, removing it once
+// there is nothing left to undo.
+func saveJournal() error {
+	if len(journal) == 0 {
+		err := os.Remove(FilePath.JournalPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(journal, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := FilePath.JournalPath + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, FilePath.JournalPath)
+}
+
+func IsJournalFileExists() bool {
+	_, err := os.Stat(FilePath.JournalPath)
+	return err == nil
+}
+
+// RepairNetwork undoes, newest first, every change recorded in a journal
+// left behind by a client that did not shut down cleanly. It must not be
+// called while a client is running.
+func RepairNetwork() error {
+	file, err := os.ReadFile(FilePath.JournalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var entries []JournalEntry
+	if err := json.Unmarshal(file, &entries); err != nil {
+		return err
+	}
+	log.Printf("Restoring network configuration, %d change(s) to undo", len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		// Changes may not have been applied before the crash, so errors
+		// are expected here
+		if err := undoEntry(entries[i]); err != nil {
+			log.Print(err)
+		}
+	}
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	journal = nil
+	return saveJournal()
+}
+
+func undoEntry(e JournalEntry) error {
+	switch e.Kind {
+	case JournalRoute:
+		return delRoute(*e.Route)
+	case JournalRule:
+		return delRule(*e.Rule)
+	case JournalTable:
+		return flushTable(e.Table)
+	case JournalTun:
+		tun.ResetRoute(*e.Config)
+	case JournalDNS:
+		return restoreDNS(*e.DNS)
+	case JournalKillSwitch:
+		return deleteRuleset(killSwitchTable)
+	case JournalDNSBlock:
+		return deleteRuleset(dnsBlockTable)
+	}
+	return nil
+}
+
+// applyRoute adds r, journaling it first.
+func applyRoute(r Route) error {
+	e := JournalEntry{Kind: JournalRoute, Route: &r}
+	journalRecord(e)
+	err := addRoute(r)
+	if err != nil {
+		journalForget(e)
+	}
+	return err
+}
+
+// revertRoute deletes a route added by applyRoute.
+func revertRoute(r Route) error {
+	err := delRoute(r)
+	journalForget(JournalEntry{Kind: JournalRoute, Route: &r})
+	return err
+}
+
+// applyRule adds rule, journaling it first.
+func applyRule(rule policyRule) error {
+	e := JournalEntry{Kind: JournalRule, Rule: &rule}
+	journalRecord(e)
+	err := addRule(rule)
+	if err != nil {
+		journalForget(e)
+	}
+	return err
+}
+
+// revertRule deletes a rule added by applyRule.
+func revertRule(rule policyRule) error {
+	err := delRule(rule)
+	journalForget(JournalEntry{Kind: JournalRule, Rule: &rule})
+	return err
+}
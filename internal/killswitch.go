@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// The kill switch blocks all outgoing traffic except to the server
+// endpoints, loopback, the tun interface and optionally the LAN from the
+// moment the client is started until the user explicitly disconnects, so
+// nothing leaks over the physical interface while reconnecting.
+
+const killSwitchTable = "xtun_killswitch"
+
+var lanPrefixes = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"fc00::/7", "fe80::/10",
+}
+
+var (
+	serverIPs      = map[string][]net.IP{}
+	serverIPsMutex sync.Mutex
+)
+
+// lookupServer resolves a server host name, falling back to the addresses
+// it last resolved to, e.g. while the kill switch blocks DNS.
+func lookupServer(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	serverIPsMutex.Lock()
+	defer serverIPsMutex.Unlock()
+	if err == nil {
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		serverIPs[host] = ips
+		return addrs, nil
+	}
+	ips, ok := serverIPs[host]
+	if !ok {
+		return nil, err
+	}
+	addrs = make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+// resolveEndpoints returns the addresses of every configured endpoint.
+func resolveEndpoints(config config.Config, options IClientOptions) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, e := range GetEndpoints(config, options) {
+		host, _, err := net.SplitHostPort(e.Addr)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := lookupServer(ctx, host)
+		cancel()
+		if err != nil {
+			log.Printf("unable to resolve %s: %v", host, err)
+			continue
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("unable to resolve any server address")
+	}
+	return ips, nil
+}
+
+// killSwitchRuleset returns the nftables ruleset of the kill switch for
+// the tunnel interface dev. It replaces the kill switch atomically if
+// already installed.
+func killSwitchRuleset(dev string, options IClientOptions, servers []net.IP) string {
+	var v4, v6 []string
+	for _, ip := range servers {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed if it is missing
+	fmt.Fprintf(&b, "table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %q accept\n", dev)
+	if options.PolicyRouting {
+		fmt.Fprintf(&b, "\t\tmeta mark %d accept\n", options.FwMark)
+	}
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+	}
+	if options.KillSwitchAllowLAN {
+		for _, p := range lanPrefixes {
+			family := "ip"
+			if strings.Contains(p, ":") {
+				family = "ip6"
+			}
+			fmt.Fprintf(&b, "\t\t%s daddr %s accept\n", family, p)
+		}
+		// DHCP leases must still be renewed
+		b.WriteString("\t\tudp dport { 67, 547 } accept\n")
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// enableKillSwitch installs the kill switch letting the tunnel interface
+// dev through, replacing any previous one without a gap.
+func enableKillSwitch(config config.Config, options IClientOptions, dev string) error {
+	servers, err := resolveEndpoints(config, options)
+	if err != nil {
+		return err
+	}
+	enabled := IsKillSwitchEnabled()
+	if !enabled {
+		journalRecord(JournalEntry{Kind: JournalKillSwitch})
+	}
+	if err := applyRuleset(killSwitchRuleset(dev, options, servers)); err != nil {
+		if !enabled {
+			journalForget(JournalEntry{Kind: JournalKillSwitch})
+		}
+		return err
+	}
+	log.Printf("Kill switch enabled for %s", dev)
+	return nil
+}
+
+// disableKillSwitch removes the kill switch if installed.
+func disableKillSwitch() {
+	if !IsKillSwitchEnabled() {
+		return
+	}
+	if err := deleteRuleset(killSwitchTable); err != nil {
+		log.Print(err)
+		return
+	}
+	journalForget(JournalEntry{Kind: JournalKillSwitch})
+	log.Println("Kill switch disabled")
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// applyRuleset loads an nftables ruleset atomically.
+func applyRuleset(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func deleteRuleset(table string) error {
+	return execCmd("nft", "delete", "table", "inet", table)
+}
+
+// IsKillSwitchEnabled reports whether the kill switch table is installed.
+func IsKillSwitchEnabled() bool {
+	return exec.Command("nft", "list", "table", "inet", killSwitchTable).Run() == nil
+}
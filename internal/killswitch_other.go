@@ -0,0 +1,17 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+func applyRuleset(ruleset string) error {
+	return errors.New("kill switch is not supported on this platform")
+}
+
+func deleteRuleset(table string) error {
+	return nil
+}
+
+func IsKillSwitchEnabled() bool {
+	return false
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRuleset(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  bool
+		lan     bool
+		servers []net.IP
+		want    []string
+		notWant []string
+	}{
+		{"ipv4 server", false, false, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")},
+			[]string{"policy drop;", `oifname "lo" accept`, `oifname "tun0" accept`, "ip daddr { 192.0.2.1, 192.0.2.2 } accept"},
+			[]string{"ip6 daddr", "meta mark", "udp dport"}},
+		{"dual stack server", false, false, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			[]string{"ip daddr { 192.0.2.1 } accept", "ip6 daddr { 2001:db8::1 } accept"}, nil},
+		{"policy routing", true, false, []net.IP{net.ParseIP("192.0.2.1")},
+			[]string{"meta mark 30836 accept"}, nil},
+		{"allow lan", false, true, []net.IP{net.ParseIP("192.0.2.1")},
+			[]string{"ip daddr 192.168.0.0/16 accept", "ip6 daddr fe80::/10 accept", "udp dport { 67, 547 } accept"}, nil},
+	}
+	for _, tt := range tests {
+		options := DefaultOptions
+		options.PolicyRouting, options.KillSwitchAllowLAN = tt.policy, tt.lan
+		ruleset := killSwitchRuleset("tun0", options, tt.servers)
+		// The ruleset replaces a kill switch already installed
+		if !strings.HasPrefix(ruleset, "table inet "+killSwitchTable+"\ndelete table inet "+killSwitchTable+"\n") {
+			t.Errorf("%s: ruleset doesn't replace the table:\n%s", tt.name, ruleset)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(ruleset, s) {
+				t.Errorf("%s: ruleset lacks %q:\n%s", tt.name, s, ruleset)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(ruleset, s) {
+				t.Errorf("%s: ruleset holds %q:\n%s", tt.name, s, ruleset)
+			}
+		}
+	}
+}
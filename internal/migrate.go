@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// DrainTimeout is how long a replaced connection may keep delivering
+// packets from the server before it is closed.
+var DrainTimeout = 10 * time.Second
+
+// sessionMutex serializes replacing the primary connection, by
+// MigrateConnection and by StartClient after it died.
+var sessionMutex sync.Mutex
+
+// MigrateConnection dials a replacement ws connection while the current one
+// keeps carrying traffic. Once the new connection is established (and thus
+// authenticated by the server), tunToWs is switched over to it and the old
+// connection is drained and closed. The extra streams follow on their own.
+func MigrateConnection(config config.Config) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if GetConnectionState() != Connected {
+		return errors.New("unable to migrate: client is not connected")
+	}
+	v, ok := cache.GetCache().Get("iface")
+	if !ok {
+		return errors.New("unable to migrate: tun interface is not available")
+	}
+	iface := v.(packetDevice)
+
+	log.Println("Migrating ws connection...")
+	conn, err := connect(config)
+	if err != nil {
+		return err
+	}
+	old := getWsConn()
+	cache.GetCache().Set("wsconn", conn, 24*time.Hour)
+	go wsToTun(config, conn, iface)
+	if old != nil {
+		go drain(old)
+	}
+	if v, ok := cache.GetCache().Get("streams"); ok {
+		v.(*streamSet).migrate(config.ServerAddr)
+	}
+	log.Println("Connection migrated")
+	return nil
+}
+
+// drain gives the server time to flush packets queued on a replaced
+// connection before closing it.
+func drain(conn net.Conn) {
+	time.Sleep(DrainTimeout)
+	conn.Close()
+}
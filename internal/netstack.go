@@ -0,0 +1,191 @@
+//go:build netstack
+
+package internal
+
+// The userspace stack is gVisor's netstack, which is only built in with
+// -tags netstack as it adds a large dependency. gVisor is pinned in go.mod
+// to a commit of its "go" branch.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// UserStackAvailable reports whether the userspace mode is built in.
+const UserStackAvailable = true
+
+const netstackNIC = 1
+
+// netstack feeds packets from the tunnel into a gVisor stack and hands
+// the packets it sends back to tunToWs through Read.
+type netstack struct {
+	ep       *channel.Endpoint
+	stack    *stack.Stack
+	outgoing chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newUserStack(addrs []netip.Prefix, mtu int) (userStack, error) {
+	s := &netstack{
+		ep: channel.New(1024, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+			HandleLocal:        true,
+		}),
+		outgoing: make(chan []byte, 1024),
+		closed:   make(chan struct{}),
+	}
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, fmt.Errorf("netstack: %v", err)
+	}
+	s.ep.AddNotify(s)
+	if err := s.stack.CreateNIC(netstackNIC, s.ep); err != nil {
+		return nil, fmt.Errorf("netstack: %v", err)
+	}
+	for _, p := range addrs {
+		protocol := ipv4.ProtocolNumber
+		if p.Addr().Is6() {
+			protocol = ipv6.ProtocolNumber
+		}
+		addr := tcpip.ProtocolAddress{
+			Protocol: protocol,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(p.Addr().AsSlice()),
+				PrefixLen: p.Bits(),
+			},
+		}
+		if err := s.stack.AddProtocolAddress(netstackNIC, addr, stack.AddressProperties{}); err != nil {
+			return nil, fmt.Errorf("netstack: %s: %v", p, err)
+		}
+	}
+	s.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: netstackNIC})
+	s.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: netstackNIC})
+	return s, nil
+}
+
+func (s *netstack) Name() string {
+	return "netstack"
+}
+
+// Read returns the next packet sent by the stack.
+func (s *netstack) Read(b []byte) (int, error) {
+	select {
+	case packet := <-s.outgoing:
+		return copy(b, packet), nil
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write delivers a packet from the tunnel to the stack.
+func (s *netstack) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+	switch b[0] >> 4 {
+	case 4:
+		s.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		s.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	default:
+		pkb.DecRef()
+		return 0, errors.New("netstack: unknown IP version")
+	}
+	return len(b), nil
+}
+
+// WriteNotify is called by the channel endpoint when the stack sent a
+// packet.
+func (s *netstack) WriteNotify() {
+	pkt := s.ep.Read()
+	if pkt == nil {
+		return
+	}
+	view := pkt.ToView()
+	pkt.DecRef()
+	packet := append([]byte{}, view.AsSlice()...)
+	view.Release()
+	select {
+	case s.outgoing <- packet:
+	case <-s.closed:
+	}
+}
+
+func (s *netstack) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	full := tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFromSlice(ap.Addr().Unmap().AsSlice()),
+		Port: ap.Port(),
+	}
+	protocol := ipv4.ProtocolNumber
+	if ap.Addr().Unmap().Is6() {
+		protocol = ipv6.ProtocolNumber
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := gonet.DialContextTCP(ctx, s.stack, full, protocol)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case "udp", "udp4", "udp6":
+		conn, err := gonet.DialUDP(s.stack, nil, &full, protocol)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("netstack: unsupported network %s", network)
+}
+
+func (s *netstack) ListenTCP(addr netip.AddrPort) (net.Listener, error) {
+	full := tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFromSlice(addr.Addr().AsSlice()),
+		Port: addr.Port(),
+	}
+	protocol := ipv4.ProtocolNumber
+	if addr.Addr().Is6() {
+		protocol = ipv6.ProtocolNumber
+	}
+	l, err := gonet.ListenTCP(s.stack, full, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *netstack) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.stack.RemoveNIC(netstackNIC)
+		s.stack.Close()
+		s.ep.Close()
+	})
+	return nil
+}
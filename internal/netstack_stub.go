@@ -0,0 +1,16 @@
+//go:build !netstack
+
+package internal
+
+// The default build has no userspace mode: gVisor is only compiled in
+// with -tags netstack, see netstack.go. UserspaceStack is refused before
+// connecting, and the option is disabled in the UI.
+
+import "net/netip"
+
+// UserStackAvailable reports whether the userspace mode is built in.
+const UserStackAvailable = false
+
+func newUserStack(addrs []netip.Prefix, mtu int) (userStack, error) {
+	return nil, errUserStackUnavailable
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+var errNetWatchUnsupported = errors.New("network change detection is not supported on this platform")
+
+// NetworkSettleDelay is how long the network must stay quiet after a
+// change before the client reacts, so that a flapping interface causes a
+// single reconnect.
+var NetworkSettleDelay = 2 * time.Second
+
+// MinReconnectInterval is the minimum time between two reconnects caused
+// by network changes.
+var MinReconnectInterval = 10 * time.Second
+
+// networkWatcher reconnects the client when the physical network changes,
+// e.g. after switching Wi-Fi or docking, instead of waiting for the dead
+// connection to time out.
+type networkWatcher struct {
+	stop chan struct{}
+}
+
+// startNetworkWatcher watches for link, address and default route changes
+// of every interface but the tun interface dev.
+func startNetworkWatcher(config config.Config, dev string) *networkWatcher {
+	w := &networkWatcher{stop: make(chan struct{})}
+	ignore := 0
+	if iface, err := net.InterfaceByName(dev); err == nil {
+		ignore = iface.Index
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		if err := watchNetwork(ignore, events, w.stop); err != nil {
+			log.Printf("network change detection disabled: %v", err)
+		}
+	}()
+	go w.debounce(config, events)
+	return w
+}
+
+func (w *networkWatcher) debounce(config config.Config, events <-chan struct{}) {
+	var settle <-chan time.Time
+	var last time.Time
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-events:
+			settle = time.After(NetworkSettleDelay)
+		case <-settle:
+			settle = nil
+			if wait := MinReconnectInterval - time.Since(last); wait > 0 {
+				settle = time.After(wait)
+				continue
+			}
+			last = time.Now()
+			handleNetworkChange(config)
+		}
+	}
+}
+
+func (w *networkWatcher) Close() {
+	close(w.stop)
+}
+
+// handleNetworkChange refreshes the gateways and the routes depending on
+// them, then moves the session to a new connection. The old connection is
+// closed if that fails, so that StartClient reconnects.
+func handleNetworkChange(config config.Config) {
+	if GetConnectionState() != Connected {
+		// StartClient is reconnecting already
+		return
+	}
+	log.Println("Network change detected, reconnecting...")
+	oldGateway, oldGatewayV6, oldGatewayV6Dev := getLocalGateway(), ClientOptions.LocalGatewayV6, ClientOptions.LocalGatewayV6Dev
+	discoverGateways(&config)
+	if err := pinServerRoutes(config); err != nil {
+		log.Print(err)
+	}
+	if config.LocalGateway != oldGateway || ClientOptions.LocalGatewayV6 != oldGatewayV6 ||
+		ClientOptions.LocalGatewayV6Dev != oldGatewayV6Dev {
+		if err := reinstallRoutes(); err != nil {
+			log.Print(err)
+		}
+	}
+	if addr := GetActiveEndpoint(); addr != "" {
+		config.ServerAddr = addr
+	}
+	if err := MigrateConnection(config); err != nil {
+		log.Printf("unable to migrate after network change: %v", err)
+		if conn := getWsConn(); conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Multicast groups of rtnetlink, see rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchNetwork sends to events whenever a link goes up or down, an address
+// is added or removed, or a default route of the main table changes, on
+// any interface but ignore. It returns once stop is closed.
+func watchNetwork(ignore int, events chan<- struct{}, stop <-chan struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var groups uint32 = rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr | rtmgrpIPv4Route | rtmgrpIPv6Route
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		return err
+	}
+	// Wake up regularly to notice stop
+	timeout := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+
+	f := newNetlinkFilter(ignore)
+	buf := make([]byte, 65536)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if f.changed(m) {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// netlinkFilter keeps track of link states, addresses and default routes,
+// so that notifications that don't change anything, like wireless scan
+// results or refreshed address and router lifetimes, are ignored.
+type netlinkFilter struct {
+	ignore int
+	links  map[int32]uint32
+	addrs  map[string]bool
+	routes map[string]bool
+}
+
+const linkFlags = syscall.IFF_UP | syscall.IFF_RUNNING
+
+// newNetlinkFilter seeds the filter with the current state of the links,
+// addresses and routes.
+func newNetlinkFilter(ignore int) *netlinkFilter {
+	f := &netlinkFilter{
+		ignore: ignore,
+		links:  map[int32]uint32{},
+		addrs:  map[string]bool{},
+		routes: map[string]bool{},
+	}
+	for _, typ := range []int{syscall.RTM_GETLINK, syscall.RTM_GETADDR, syscall.RTM_GETROUTE} {
+		rib, err := syscall.NetlinkRIB(typ, syscall.AF_UNSPEC)
+		if err != nil {
+			continue
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			f.changed(m)
+		}
+	}
+	return f
+}
+
+// changed reports whether m describes a relevant change.
+func (f *netlinkFilter) changed(m syscall.NetlinkMessage) bool {
+	switch m.Header.Type {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		if len(m.Data) < syscall.SizeofIfInfomsg {
+			return false
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		if int(info.Index) == f.ignore {
+			return false
+		}
+		if m.Header.Type == syscall.RTM_DELLINK {
+			delete(f.links, info.Index)
+			return true
+		}
+		flags := info.Flags & linkFlags
+		old, ok := f.links[info.Index]
+		f.links[info.Index] = flags
+		return !ok || old != flags
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		if len(m.Data) < syscall.SizeofIfAddrmsg {
+			return false
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifa.Index) == f.ignore {
+			return false
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return false
+		}
+		key := fmt.Sprint(ifa.Index)
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.IFA_ADDRESS {
+				key += "/" + net.IP(a.Value).String()
+			}
+		}
+		return f.track(f.addrs, key, m.Header.Type == syscall.RTM_DELADDR)
+	case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+		if len(m.Data) < syscall.SizeofRtMsg {
+			return false
+		}
+		rt := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rt.Dst_len != 0 || rt.Table != syscall.RT_TABLE_MAIN {
+			return false
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return false
+		}
+		key := fmt.Sprint(rt.Family)
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				key += "/" + net.IP(a.Value).String()
+			case syscall.RTA_OIF:
+				if len(a.Value) >= 4 {
+					key += fmt.Sprintf("/%d", *(*uint32)(unsafe.Pointer(&a.Value[0])))
+				}
+			}
+		}
+		return f.track(f.routes, key, m.Header.Type == syscall.RTM_DELROUTE)
+	}
+	return false
+}
+
+// track adds key to or removes it from set, reporting whether set changed.
+func (f *netlinkFilter) track(set map[string]bool, key string, remove bool) bool {
+	if remove {
+		if !set[key] {
+			return false
+		}
+		delete(set, key)
+		return true
+	}
+	if set[key] {
+		return false
+	}
+	set[key] = true
+	return true
+}
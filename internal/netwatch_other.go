@@ -0,0 +1,7 @@
+//go:build !linux
+
+package internal
+
+func watchNetwork(ignore int, events chan<- struct{}, stop <-chan struct{}) error {
+	return errNetWatchUnsupported
+}
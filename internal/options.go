@@ -0,0 +1,169 @@
+package internal
+
+// IClientOptions holds client settings that are not part of xtun-core config.
+type IClientOptions struct {
+	// Endpoints are fallback servers tried after config.ServerAddr
+	Endpoints []Endpoint
+	// FailoverAttempts is the number of failed connects before moving on
+	// to the next endpoint
+	FailoverAttempts int
+	// FallbackInterval is how often (in seconds) the primary endpoint is
+	// probed while connected to a fallback one
+	FallbackInterval int
+	// AutoSelect orders endpoints by measured latency before connecting
+	AutoSelect bool
+	// PinnedEndpoint, when set, is always tried first
+	PinnedEndpoint string
+	// ProbeInterval is how often (in seconds) endpoints are re-probed
+	// while idle in auto mode
+	ProbeInterval int
+	// StreamCount is the number of ws connections opened per session
+	StreamCount int
+	// DialTimeout is the timeout (in seconds) of a single connection
+	// attempt to one of the server addresses
+	DialTimeout int
+	// IncludeRoutes, when not empty, are the only prefixes routed through
+	// the tunnel
+	IncludeRoutes []string
+	// ExcludeRoutes are prefixes that bypass the tunnel
+	ExcludeRoutes []string
+	// DomainRoutes are domain names whose addresses are routed through
+	// the tunnel, e.g. "internal.corp" or "*.git.example". The host sends
+	// their queries to the local resolver, which without ApplyDNS needs
+	// systemd-resolved
+	DomainRoutes []string
+	// DNSForwarder runs the local resolver for all queries of the host,
+	// not only for domain routes. With ApplyDNS the host resolver is
+	// pointed at it, which needs ResolverAddr on port 53
+	DNSForwarder bool
+	// ResolverAddr is where the local resolver listens
+	ResolverAddr string
+	// ResolverUpstreams are the DNS servers the local resolver forwards
+	// to, e.g. "10.0.0.1", "tcp://10.0.0.1:53" or
+	// "https://10.0.0.1/dns-query". The servers pushed by the server or
+	// the system nameserver are used if empty
+	ResolverUpstreams []string
+	// AcceptServerRoutes merges routes pushed by the server with the local
+	// include and exclude lists, see MergeRoutes
+	AcceptServerRoutes bool
+	// ServerRoutes are the routes last pushed by the server
+	ServerRoutes PushedRoutes
+	// PolicyRouting installs tunnel routes into RoutingTable selected by ip
+	// rules instead of changing the main table (Linux only)
+	PolicyRouting bool
+	// RoutingTable is the routing table used with PolicyRouting
+	RoutingTable int
+	// FwMark marks the client's own sockets to bypass RoutingTable
+	FwMark int
+	// CIDRv6 is the IPv6 address assigned to the client, empty if the
+	// server is IPv4 only
+	CIDRv6 string
+	// ServerIPv6 is the server's IPv6 address in the tunnel
+	ServerIPv6 string
+	// LocalGatewayV6 is the IPv6 gateway of the physical network
+	LocalGatewayV6 string
+	// LocalGatewayV6Dev is the interface of LocalGatewayV6, which is
+	// needed to route via a link-local address
+	LocalGatewayV6Dev string
+	// BlockIPv6 makes IPv6 unreachable in full tunnel mode when the server
+	// doesn't assign an IPv6 address, so that it can't bypass the tunnel
+	BlockIPv6 bool
+	// KillSwitch blocks traffic outside the tunnel while the client is
+	// enabled (Linux only)
+	KillSwitch bool
+	// KillSwitchAllowLAN lets local network traffic through the kill switch
+	KillSwitchAllowLAN bool
+	// ApplyDNS configures the DNS servers pushed by the server on the host
+	ApplyDNS bool
+	// BlockOffTunnelDNS drops DNS queries not sent through the tunnel
+	BlockOffTunnelDNS bool
+	// ServerDNS is the DNS configuration last pushed by the server
+	ServerDNS PushedDNS
+	// UserspaceStack runs a TCP/IP stack in the client instead of creating
+	// a tun interface, which needs no privileges. Applications reach the
+	// tunnel through the proxies. Only available in builds with
+	// -tags netstack, see UserStackAvailable
+	UserspaceStack bool
+	// SOCKSAddr is where the SOCKS5 proxy of the userspace stack listens,
+	// disabled if empty
+	SOCKSAddr string
+	// HTTPProxyAddr is where the HTTP proxy of the userspace stack
+	// listens, disabled if empty
+	HTTPProxyAddr string
+	// TapMode creates a TAP interface carrying Ethernet frames instead of
+	// a tun interface, if the server supports it (Linux only)
+	TapMode bool
+	// TapMAC is the MAC address of the TAP interface, generated on first
+	// use
+	TapMAC string
+	// Forwards are local port forwards to addresses behind the tunnel
+	Forwards []Forward
+	// ReverseForwards expose local services to VPN peers on the tunnel
+	// address
+	ReverseForwards []ReverseForward
+	// ReverseForwardPeers are the addresses or prefixes of the peers
+	// allowed to connect to ReverseForwards, none if empty
+	ReverseForwardPeers []string
+	// ProvisioningURL is the HTTPS address the profile is provisioned
+	// from, see Provision
+	ProvisioningURL string
+	// ProvisioningKey is the base64 Ed25519 public key provisioned
+	// profiles must be signed with
+	ProvisioningKey string
+	// ProvisioningSerial is the serial of the last provisioned profile,
+	// lower ones are refused
+	ProvisioningSerial uint64
+	// ProvisioningDigest is the SHA-256 of the last provisioned profile,
+	// to notice a serial being reused for other settings
+	ProvisioningDigest string
+	// ProvisioningInterval is how often (in seconds) ProvisioningURL is
+	// checked for updates
+	ProvisioningInterval int
+}
+
+var DefaultOptions = IClientOptions{
+	Endpoints:            []Endpoint{},
+	FailoverAttempts:     3,
+	FallbackInterval:     60,
+	AutoSelect:           false,
+	PinnedEndpoint:       "",
+	ProbeInterval:        300,
+	StreamCount:          1,
+	DialTimeout:          5,
+	IncludeRoutes:        []string{},
+	ExcludeRoutes:        []string{},
+	DomainRoutes:         []string{},
+	DNSForwarder:         false,
+	ResolverAddr:         "127.0.0.1:53",
+	ResolverUpstreams:    []string{},
+	AcceptServerRoutes:   true,
+	ServerRoutes:         PushedRoutes{},
+	PolicyRouting:        false,
+	RoutingTable:         7874,
+	FwMark:               0x7874,
+	CIDRv6:               "",
+	ServerIPv6:           "",
+	LocalGatewayV6:       "",
+	LocalGatewayV6Dev:    "",
+	BlockIPv6:            false,
+	KillSwitch:           false,
+	KillSwitchAllowLAN:   true,
+	ApplyDNS:             true,
+	BlockOffTunnelDNS:    false,
+	ServerDNS:            PushedDNS{},
+	UserspaceStack:       false,
+	SOCKSAddr:            "127.0.0.1:1080",
+	HTTPProxyAddr:        "127.0.0.1:8080",
+	TapMode:              false,
+	TapMAC:               "",
+	Forwards:             []Forward{},
+	ReverseForwards:      []ReverseForward{},
+	ReverseForwardPeers:  []string{},
+	ProvisioningURL:      "",
+	ProvisioningKey:      "",
+	ProvisioningSerial:   0,
+	ProvisioningDigest:   "",
+	ProvisioningInterval: 3600,
+}
+
+var ClientOptions IClientOptions
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"log"
+	"strconv"
+)
+
+// Policy routing keeps the main routing table untouched: tunnel routes are
+// installed into a dedicated table which all traffic not carrying the
+// client's fwmark is looked up in. The client marks its own sockets so that
+// the connection to the server keeps using the main table.
+
+type policyRule struct {
+	Family   string
+	Selector []string
+}
+
+// policyRules returns the rules used for policy routing in the order they
+// are added. Rules added later get a higher preference, so the main table
+// is consulted first for anything but its default route and unmarked
+// traffic falls through to the tunnel table.
+func policyRules(options IClientOptions) []policyRule {
+	table := strconv.Itoa(options.RoutingTable)
+	mark := strconv.Itoa(options.FwMark)
+	rules := []policyRule{}
+	for _, family := range []string{"-4", "-6"} {
+		rules = append(rules,
+			policyRule{family, []string{"not", "fwmark", mark, "table", table}},
+			policyRule{family, []string{"table", "main", "suppress_prefixlength", "0"}},
+		)
+	}
+	return rules
+}
+
+// addPolicyRules installs the rules selecting the tunnel routing table.
+func addPolicyRules(options IClientOptions) error {
+	journalRecord(JournalEntry{Kind: JournalTable, Table: options.RoutingTable})
+	rules := policyRules(options)
+	for i, rule := range rules {
+		if err := applyRule(rule); err != nil {
+			for _, rule := range rules[:i] {
+				revertRule(rule)
+			}
+			journalForget(JournalEntry{Kind: JournalTable, Table: options.RoutingTable})
+			return err
+		}
+	}
+	return nil
+}
+
+// delPolicyRules removes the rules installed by addPolicyRules and flushes
+// the tunnel routing table.
+func delPolicyRules(options IClientOptions) {
+	for _, rule := range policyRules(options) {
+		if err := revertRule(rule); err != nil {
+			log.Print(err)
+		}
+	}
+	if err := flushTable(options.RoutingTable); err != nil {
+		log.Print(err)
+	}
+	journalForget(JournalEntry{Kind: JournalTable, Table: options.RoutingTable})
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"strconv"
+	"syscall"
+)
+
+func addRule(rule policyRule) error {
+	return execCmd("ip", append([]string{rule.Family, "rule", "add"}, rule.Selector...)...)
+}
+
+func delRule(rule policyRule) error {
+	return execCmd("ip", append([]string{rule.Family, "rule", "del"}, rule.Selector...)...)
+}
+
+func flushTable(table int) error {
+	for _, family := range []string{"-4", "-6"} {
+		if err := execCmd("ip", family, "route", "flush", "table", strconv.Itoa(table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markSocket sets the client's fwmark on its own sockets so that they
+// bypass the tunnel routing table.
+func markSocket(network, address string, c syscall.RawConn) error {
+	if !ClientOptions.PolicyRouting {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, ClientOptions.FwMark)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
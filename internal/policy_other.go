@@ -0,0 +1,21 @@
+//go:build !linux
+
+package internal
+
+import "syscall"
+
+func addRule(rule policyRule) error {
+	return errRoutesUnsupported
+}
+
+func delRule(rule policyRule) error {
+	return errRoutesUnsupported
+}
+
+func flushTable(table int) error {
+	return errRoutesUnsupported
+}
+
+func markSocket(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// ProbeTimeout bounds a single endpoint probe.
+var ProbeTimeout = 5 * time.Second
+
+// ProbeResult holds the latency measured for an endpoint. PingRTT is zero
+// for handshake only probes.
+type ProbeResult struct {
+	Addr         string
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	PingRTT      time.Duration
+	Err          error
+	Time         time.Time
+}
+
+// Score is used to rank endpoints; lower is better.
+func (r ProbeResult) Score() time.Duration {
+	return r.Connect + r.TLSHandshake + r.PingRTT
+}
+
+var (
+	probeResults = map[string]ProbeResult{}
+	probeMutex   sync.Mutex
+)
+
+// GetProbeResults returns the latest probe result of every endpoint,
+// ordered from best to worst.
+func GetProbeResults() []ProbeResult {
+	probeMutex.Lock()
+	results := make([]ProbeResult, 0, len(probeResults))
+	for _, r := range probeResults {
+		results = append(results, r)
+	}
+	probeMutex.Unlock()
+	sortProbeResults(results)
+	return results
+}
+
+func sortProbeResults(results []ProbeResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Err != nil || results[j].Err != nil {
+			return results[i].Err == nil && results[j].Err != nil
+		}
+		return results[i].Score() < results[j].Score()
+	})
+}
+
+// ProbeEndpoints probes all endpoints concurrently and records the results.
+func ProbeEndpoints(config config.Config, endpoints []Endpoint) []ProbeResult {
+	return probeEndpoints(config, endpoints, false)
+}
+
+// probeEndpoints probes all endpoints, only up to the TCP and TLS
+// handshakes if handshakeOnly is set, and records the results.
+func probeEndpoints(config config.Config, endpoints []Endpoint, handshakeOnly bool) []ProbeResult {
+	results := make([]ProbeResult, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i] = probeEndpoint(config, addr, handshakeOnly)
+		}(i, e.Addr)
+	}
+	wg.Wait()
+
+	probeMutex.Lock()
+	probeResults = map[string]ProbeResult{}
+	for _, r := range results {
+		probeResults[r.Addr] = r
+	}
+	probeMutex.Unlock()
+
+	sortProbeResults(results)
+	return results
+}
+
+// probeEndpoint measures the TCP connect and TLS handshake times and,
+// unless handshakeOnly is set, the ws ping round trip time of addr. Only
+// the latter opens a ws session, which sends the key.
+func probeEndpoint(config config.Config, addr string, handshakeOnly bool) ProbeResult {
+	result := ProbeResult{Addr: addr, Time: time.Now()}
+	deadline := time.Now().Add(ProbeTimeout)
+
+	conn, err := newDialer(ProbeTimeout).Dial("tcp", addr)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer conn.Close()
+	result.Connect = time.Since(result.Time)
+	conn.SetDeadline(deadline)
+
+	scheme := "ws"
+	if config.Protocol == "wss" {
+		scheme = "wss"
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		})
+		start := time.Now()
+		if err := tlsConn.Handshake(); err != nil {
+			result.Err = err
+			return result
+		}
+		result.TLSHandshake = time.Since(start)
+		conn = tlsConn
+	}
+	if handshakeOnly {
+		return result
+	}
+
+	header := make(http.Header)
+	if config.Key != "" {
+		header.Set("key", config.Key)
+	}
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(header)}
+	u := &url.URL{Scheme: scheme, Host: addr, Path: "/ws"}
+	br, _, err := dialer.Upgrade(conn, u)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	var r io.Reader = conn
+	if br != nil {
+		r = br
+	}
+
+	start := time.Now()
+	if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewPingFrame(nil))); err != nil {
+		result.Err = err
+		return result
+	}
+	for {
+		// Packets queued for us are skipped, the deadline ends the wait
+		frame, err := ws.ReadFrame(r)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if frame.Header.OpCode == ws.OpPong {
+			result.PingRTT = time.Since(start)
+			return result
+		}
+	}
+}
+
+// cachedProbeResults returns the recorded results of endpoints, ordered
+// from best to worst, if all of them were probed within maxAge.
+func cachedProbeResults(endpoints []Endpoint, maxAge time.Duration) ([]ProbeResult, bool) {
+	probeMutex.Lock()
+	defer probeMutex.Unlock()
+	results := make([]ProbeResult, 0, len(endpoints))
+	for _, e := range endpoints {
+		r, ok := probeResults[e.Addr]
+		if !ok || time.Since(r.Time) > maxAge {
+			return nil, false
+		}
+		results = append(results, r)
+	}
+	sortProbeResults(results)
+	return results, true
+}
+
+// probeInterval returns ProbeInterval as a duration.
+func probeInterval(options IClientOptions) time.Duration {
+	interval := time.Duration(options.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// selectEndpoints puts the pinned endpoint first or, when auto selection is
+// enabled, orders endpoints by measured latency, using the results of the
+// idle prober if they are recent. Endpoints that failed the probe keep
+// their relative order at the end.
+func selectEndpoints(config config.Config, options IClientOptions, endpoints []Endpoint) []Endpoint {
+	if options.PinnedEndpoint != "" {
+		ordered := []Endpoint{}
+		for _, e := range endpoints {
+			if e.Addr == options.PinnedEndpoint {
+				ordered = append([]Endpoint{e}, ordered...)
+			} else {
+				ordered = append(ordered, e)
+			}
+		}
+		return ordered
+	}
+	if !options.AutoSelect || len(endpoints) < 2 {
+		return endpoints
+	}
+	results, ok := cachedProbeResults(endpoints, 2*probeInterval(options))
+	if !ok {
+		results = ProbeEndpoints(config, endpoints)
+	}
+	byAddr := map[string]Endpoint{}
+	for _, e := range endpoints {
+		byAddr[e.Addr] = e
+	}
+	ordered := make([]Endpoint, 0, len(endpoints))
+	for _, r := range results {
+		ordered = append(ordered, byAddr[r.Addr])
+	}
+	if results[0].Err == nil {
+		log.Printf("Selected %s (%v)", results[0].Addr, results[0].Score().Round(time.Millisecond))
+	}
+	return ordered
+}
+
+// RunIdleProber re-evaluates endpoint latency every ProbeInterval while
+// auto selection is enabled and the client is disconnected, for the next
+// connect to select from. It only measures handshakes so that no session
+// is opened.
+func RunIdleProber() {
+	for {
+		time.Sleep(probeInterval(ClientOptions))
+		if !ClientOptions.AutoSelect || GetConnectionState() != Disconnected {
+			continue
+		}
+		probeEndpoints(config.AppConfig, GetEndpoints(config.AppConfig, ClientOptions), true)
+	}
+}
@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// A profile is a named config and options pair, stored in its own
+// directory under ProfilesDir. The main tunnel uses the default profile,
+// see AppState.DefaultProfile, and other profiles can be connected
+// alongside it, see StartTunnel.
+
+var ProfilesDir = "profiles"
+
+// profilesRoot is the directory holding the profiles. It is resolved once,
+// as IsolateProfile moves DirPath.AppDataDir into a profile.
+var profilesRoot = filepath.Join(DirPath.AppDataDir, ProfilesDir)
+
+// DefaultProfileName is the profile the config of older versions is
+// migrated to.
+const DefaultProfileName = "default"
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// mainProfile is the profile in use by the main tunnel.
+var mainProfile string
+
+// CheckProfileName validates a profile name, which is used as a directory
+// name.
+func CheckProfileName(name string) error {
+	if !profileNameRegexp.MatchString(name) || len(name) > 64 {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+func profileDir(name string) string {
+	return filepath.Join(profilesRoot, name)
+}
+
+// IsProfileExists reports whether a profile is saved.
+func IsProfileExists(name string) bool {
+	_, err := os.Stat(filepath.Join(profileDir(name), ConfigFile))
+	return err == nil
+}
+
+// DefaultConfig returns the config of a new profile.
+func DefaultConfig() config.Config {
+	return config.Config{
+		DeviceName:         "xtun",
+		Key:                "xtun@2023",
+		BufferSize:         65536,
+		MTU:                1500,
+		InsecureSkipVerify: false,
+		Compress:           false,
+		GlobalMode:         true,
+		ServerMode:         false,
+		GUIMode:            true,
+		Protocol:           "wss",
+	}
+}
+
+// ListProfiles returns the names of the saved profiles, sorted.
+func ListProfiles() ([]string, error) {
+	entries, err := os.ReadDir(profilesRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() && CheckProfileName(e.Name()) == nil && IsProfileExists(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadProfile reads the config and options of a profile. Options missing
+// from the file keep their defaults.
+func LoadProfile(name string) (config.Config, IClientOptions, error) {
+	var c config.Config
+	options := DefaultOptions
+	if err := CheckProfileName(name); err != nil {
+		return c, options, err
+	}
+	dir := profileDir(name)
+	file, err := os.ReadFile(filepath.Join(dir, ConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, options, errors.New("no such profile: " + name)
+		}
+		return c, options, err
+	}
+	if err := json.Unmarshal(file, &c); err != nil {
+		return c, options, err
+	}
+	file, err = os.ReadFile(filepath.Join(dir, OptionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return c, options, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, &options); err != nil {
+			return c, options, err
+		}
+	}
+	return c, options, nil
+}
+
+// SaveProfile writes the config and options of a profile, creating it if
+// needed.
+func SaveProfile(name string, c config.Config, options IClientOptions) error {
+	if err := CheckProfileName(name); err != nil {
+		return err
+	}
+	dir := profileDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := json.MarshalIndent(c, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ConfigFile), file, 0644); err != nil {
+		return err
+	}
+	file, err = json.MarshalIndent(options, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, OptionsFile), file, 0644)
+}
+
+// checkIdle returns an error if the profile is in use by a tunnel.
+func checkIdle(name string) error {
+	if name == mainProfile && GetConnectionState() != Disconnected {
+		return fmt.Errorf("profile %s is connected", name)
+	}
+	if IsTunnelRunning(name) {
+		return fmt.Errorf("profile %s is connected", name)
+	}
+	if _, err := os.Stat(filepath.Join(profileDir(name), JournalFile)); err == nil {
+		return fmt.Errorf("profile %s has network changes to undo, run repair %s first", name, name)
+	}
+	return nil
+}
+
+// CloneProfile saves a copy of profile src as dst. The copy shares the
+// device identity of src, so both can't be connected at the same time.
+func CloneProfile(src string, dst string) error {
+	if err := CheckProfileName(dst); err != nil {
+		return err
+	}
+	if IsProfileExists(dst) {
+		return fmt.Errorf("profile %s already exists", dst)
+	}
+	c, options, err := LoadProfile(src)
+	if err != nil {
+		return err
+	}
+	return SaveProfile(dst, c, options)
+}
+
+// RenameProfile renames a profile that isn't connected, following it if
+// it is the default one.
+func RenameProfile(name string, newName string) error {
+	if err := CheckProfileName(newName); err != nil {
+		return err
+	}
+	if !IsProfileExists(name) {
+		return errors.New("no such profile: " + name)
+	}
+	if _, err := os.Stat(profileDir(newName)); err == nil {
+		return fmt.Errorf("profile %s already exists", newName)
+	}
+	if err := checkIdle(name); err != nil {
+		return err
+	}
+	if err := os.Rename(profileDir(name), profileDir(newName)); err != nil {
+		return err
+	}
+	if AppState.DefaultProfile == name {
+		AppState.DefaultProfile = newName
+		if err := SaveStateFile(AppState); err != nil {
+			return err
+		}
+	}
+	if mainProfile == name {
+		return UseProfile(newName)
+	}
+	return nil
+}
+
+// DeleteProfile removes a profile that isn't connected. The default
+// profile can't be deleted.
+func DeleteProfile(name string) error {
+	if err := CheckProfileName(name); err != nil {
+		return err
+	}
+	if name == GetDefaultProfile() {
+		return fmt.Errorf("profile %s is the default one", name)
+	}
+	if err := checkIdle(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(profileDir(name))
+}
+
+// GetDefaultProfile returns the name of the profile used by the main
+// tunnel.
+func GetDefaultProfile() string {
+	if AppState.DefaultProfile == "" {
+		return DefaultProfileName
+	}
+	return AppState.DefaultProfile
+}
+
+// GetMainProfile returns the name of the profile loaded for the main
+// tunnel.
+func GetMainProfile() string {
+	return mainProfile
+}
+
+// SetDefaultProfile makes the main tunnel use a profile from now on. The
+// main tunnel must be disconnected.
+func SetDefaultProfile(name string) error {
+	if !IsProfileExists(name) {
+		return errors.New("no such profile: " + name)
+	}
+	if GetConnectionState() != Disconnected {
+		return errors.New("disconnect before switching profiles")
+	}
+	if IsTunnelRunning(name) {
+		return fmt.Errorf("profile %s is connected", name)
+	}
+	if err := UseProfile(name); err != nil {
+		return err
+	}
+	AppState.DefaultProfile = name
+	return SaveStateFile(AppState)
+}
+
+// UseProfile loads the config and options of a profile, which are saved
+// back to it from then on.
+func UseProfile(name string) error {
+	c, options, err := LoadProfile(name)
+	if err != nil {
+		return err
+	}
+	dir := profileDir(name)
+	FilePath.ConfigPath = filepath.Join(dir, ConfigFile)
+	FilePath.OptionsPath = filepath.Join(dir, OptionsFile)
+	config.AppConfig = c
+	ClientOptions = options
+	mainProfile = name
+	log.Printf("Using profile %s", name)
+	return nil
+}
+
+// IsolateProfile keeps the journal, pid file and DNS backup of this
+// process in the directory of the profile in use, for a process running
+// the tunnel of a profile other than the main one.
+func IsolateProfile() {
+	dir := profileDir(mainProfile)
+	DirPath.AppDataDir = dir
+	FilePath.JournalPath = filepath.Join(dir, JournalFile)
+	FilePath.PidPath = filepath.Join(dir, PidFile)
+}
+
+// MigrateConfig moves the config and options of versions without
+// profiles into the default profile.
+func MigrateConfig() error {
+	if !IsConfigFileExists() || IsProfileExists(DefaultProfileName) {
+		return nil
+	}
+	if err := LoadConfigFile(); err != nil {
+		return err
+	}
+	if IsOptionsFileExists() {
+		if err := LoadOptionsFile(); err != nil {
+			return err
+		}
+	}
+	if err := SaveProfile(DefaultProfileName, config.AppConfig, ClientOptions); err != nil {
+		return err
+	}
+	AppState.DefaultProfile = DefaultProfileName
+	if err := SaveStateFile(AppState); err != nil {
+		return err
+	}
+	log.Printf("Configuration moved to profile %s", DefaultProfileName)
+	os.Remove(FilePath.OptionsPath)
+	return os.Remove(FilePath.ConfigPath)
+}
+
+// SyncServerSettings copies the tunnel settings and the configuration
+// pushed by the server into c and options.
+func SyncServerSettings(c *config.Config, options *IClientOptions) error {
+	res, err := GetServerConfiguration(*c)
+	if err != nil {
+		return err
+	}
+	c.BufferSize = res.BufferSize
+	c.MTU = res.MTU
+	c.Compress = res.Compress
+	options.ServerRoutes = res.PushedRoutes
+	options.ServerDNS = res.PushedDNS
+	return nil
+}
+
+// RegisterDevice registers a new device with the server and stores the
+// identity and addresses it was assigned in c and options.
+func RegisterDevice(c *config.Config, options *IClientOptions) error {
+	// DeviceId is set by GetIP
+	req, res, err := GetIP(*c)
+	if err != nil {
+		return err
+	}
+	c.DeviceId = req.DeviceId
+	c.CIDR = res.Client
+	c.ServerIP = res.Server
+	options.CIDRv6 = res.ClientV6
+	options.ServerIPv6 = res.ServerV6
+	if len(res.Include) > 0 || len(res.Exclude) > 0 {
+		options.ServerRoutes = res.PushedRoutes
+	}
+	if len(res.Servers) > 0 {
+		options.ServerDNS = res.PushedDNS
+	}
+	return nil
+}
+
+// NewProfile registers a device with server and saves it as a new
+// profile whose tunnel interface is named device.
+func NewProfile(name string, server string, key string, device string) error {
+	if err := CheckProfileName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(profileDir(name)); err == nil {
+		return fmt.Errorf("profile %s already exists", name)
+	}
+	c := DefaultConfig()
+	c.ServerAddr = server
+	c.Key = key
+	if device != "" {
+		c.DeviceName = device
+	}
+	options := DefaultOptions
+	if err := SyncServerSettings(&c, &options); err != nil {
+		return err
+	}
+	if err := RegisterDevice(&c, &options); err != nil {
+		return err
+	}
+	return SaveProfile(name, c, options)
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+func TestCheckProfileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"default", true},
+		{"office-2.backup_1", true},
+		{"0", true},
+		{"", false},
+		{".hidden", false},
+		{"-flag", false},
+		{"../etc", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"with space", false},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+	}
+	for _, tt := range tests {
+		if err := CheckProfileName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("CheckProfileName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	savedPaths, savedRoot, savedState := FilePath, profilesRoot, AppState
+	savedConfig, savedOptions := config.AppConfig, ClientOptions
+	defer func() {
+		FilePath, profilesRoot, AppState = savedPaths, savedRoot, savedState
+		config.AppConfig, ClientOptions = savedConfig, savedOptions
+	}()
+
+	tests := []struct {
+		name string
+		// legacy is whether a config without profiles is present
+		legacy bool
+		// existing is whether the default profile already exists
+		existing bool
+		migrated bool
+	}{
+		{"fresh install", false, false, false},
+		{"legacy config", true, false, true},
+		{"already migrated", true, true, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		FilePath.ConfigPath = filepath.Join(dir, ConfigFile)
+		FilePath.OptionsPath = filepath.Join(dir, OptionsFile)
+		FilePath.StatePath = filepath.Join(dir, StateFile)
+		profilesRoot = filepath.Join(dir, ProfilesDir)
+		AppState = IAppState{}
+		if tt.existing {
+			if err := SaveProfile(DefaultProfileName, DefaultConfig(), DefaultOptions); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.legacy {
+			c := DefaultConfig()
+			c.ServerAddr = "vpn.example.com:443"
+			options := DefaultOptions
+			options.IncludeRoutes = []string{"10.0.0.0/8"}
+			if err := SaveConfigFile(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := SaveOptionsFile(options); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := MigrateConfig(); err != nil {
+			t.Fatalf("%s: MigrateConfig: %v", tt.name, err)
+		}
+		c, options, err := LoadProfile(DefaultProfileName)
+		migrated := err == nil && c.ServerAddr == "vpn.example.com:443" && len(options.IncludeRoutes) == 1
+		if migrated != tt.migrated {
+			t.Errorf("%s: migrated = %v, want %v", tt.name, migrated, tt.migrated)
+		}
+		if _, err := os.Stat(FilePath.ConfigPath); tt.legacy && os.IsNotExist(err) != tt.migrated {
+			t.Errorf("%s: legacy config removed = %v, want %v", tt.name, os.IsNotExist(err), tt.migrated)
+		}
+		if tt.migrated && AppState.DefaultProfile != DefaultProfileName {
+			t.Errorf("%s: default profile %q, want %q", tt.name, AppState.DefaultProfile, DefaultProfileName)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// A profile can be provisioned from an HTTPS URL serving a profile bundle
+// signed with Ed25519, so that an administrator can roll out and update
+// profiles of many clients. A bundle is applied only if it is signed with
+// the ProvisioningKey of the profile and its serial isn't lower than the
+// one last applied.
+
+// maxProvisionSize limits the size of a provisioning document.
+const maxProvisionSize = 1 << 20
+
+// ProvisionedProfile is the signed content of a provisioning document.
+type ProvisionedProfile struct {
+	Serial  uint64        `json:"serial"`
+	Profile ProfileBundle `json:"profile"`
+}
+
+// provisionDocument is served at a provisioning URL. Payload is the JSON
+// encoded ProvisionedProfile and Signature its Ed25519 signature, both
+// base64 encoded.
+type provisionDocument struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+var provisionClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: newDialer(30 * time.Second).DialContext,
+	},
+	Timeout: 60 * time.Second,
+}
+
+// lastProvisionCheck is when each profile was last checked by
+// RunProvisioner.
+var lastProvisionCheck = map[string]time.Time{}
+
+// provisionedMain is an update of the main profile waiting to be applied
+// by ApplyProvisionedProfile, as config.AppConfig and ClientOptions belong
+// to the UI.
+var provisionedMain struct {
+	sync.Mutex
+	pending bool
+	name    string
+	config  config.Config
+	options IClientOptions
+}
+
+// ParseProvisioningKey decodes a base64 Ed25519 public key.
+func ParseProvisioningKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid provisioning key: expected a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// GenerateProvisioningKey returns a new key pair for signing provisioning
+// documents, both base64 encoded.
+func GenerateProvisioningKey() (string, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private), nil
+}
+
+// SignProvision returns the provisioning document of p signed with a
+// base64 Ed25519 private key.
+func SignProvision(p ProvisionedProfile, privateKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid signing key: expected a base64 Ed25519 private key")
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(provisionDocument{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key), payload)),
+	}, "", " ")
+}
+
+// VerifyProvision checks the signature of a provisioning document and
+// returns its content.
+func VerifyProvision(data []byte, key ed25519.PublicKey) (ProvisionedProfile, error) {
+	var p ProvisionedProfile
+	var doc provisionDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return p, fmt.Errorf("invalid provisioning document: %v", err)
+	}
+	if doc.Signature == "" {
+		return p, errors.New("provisioning document isn't signed")
+	}
+	payload, err1 := base64.StdEncoding.DecodeString(doc.Payload)
+	signature, err2 := base64.StdEncoding.DecodeString(doc.Signature)
+	if err := errors.Join(err1, err2); err != nil {
+		return p, fmt.Errorf("invalid provisioning document: %v", err)
+	}
+	if !ed25519.Verify(key, payload, signature) {
+		return p, errors.New("provisioning document signature doesn't match the provisioning key")
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return p, fmt.Errorf("invalid provisioned profile: %v", err)
+	}
+	return p, nil
+}
+
+func fetchProvision(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("provisioning URL must be https: %s", rawURL)
+	}
+	res, err := provisionClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provisioning server returned %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxProvisionSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxProvisionSize {
+		return nil, errors.New("provisioning document is too large")
+	}
+	return data, nil
+}
+
+// Provision fetches the signed profile served at rawURL and applies it to
+// profile name, creating the profile if needed. The URL and key are kept
+// in the profile to check for updates, see RunProvisioner. It returns
+// whether the profile changed.
+func Provision(name string, rawURL string, key string) (bool, error) {
+	if err := CheckProfileName(name); err != nil {
+		return false, err
+	}
+	publicKey, err := ParseProvisioningKey(key)
+	if err != nil {
+		return false, err
+	}
+	data, err := fetchProvision(rawURL)
+	if err != nil {
+		return false, err
+	}
+	p, err := VerifyProvision(data, publicKey)
+	if err != nil {
+		return false, err
+	}
+	p.Profile.Name = name
+	if err := ValidateProfileBundle(p.Profile); err != nil {
+		return false, err
+	}
+	digest, err := provisionDigest(p.Profile)
+	if err != nil {
+		return false, err
+	}
+
+	if !IsProfileExists(name) {
+		c := DefaultConfig()
+		options := DefaultOptions
+		applyProfileBundle(&c, &options, p.Profile)
+		options.ProvisioningURL = rawURL
+		options.ProvisioningKey = key
+		options.ProvisioningSerial = p.Serial
+		options.ProvisioningDigest = digest
+		if err := SyncServerSettings(&c, &options); err != nil {
+			return false, err
+		}
+		if err := RegisterDevice(&c, &options); err != nil {
+			return false, err
+		}
+		log.Printf("Profile %s provisioned, serial %d", name, p.Serial)
+		return true, SaveProfile(name, c, options)
+	}
+
+	c, options, err := LoadProfile(name)
+	if err != nil {
+		return false, err
+	}
+	if p.Serial < options.ProvisioningSerial {
+		return false, fmt.Errorf("refusing provisioned profile %s: serial %d is lower than %d", name, p.Serial, options.ProvisioningSerial)
+	}
+	if p.Serial == options.ProvisioningSerial && options.ProvisioningURL == rawURL && options.ProvisioningKey == key {
+		if options.ProvisioningDigest != "" && options.ProvisioningDigest != digest {
+			log.Printf("Profile %s: serial %d is served with different settings than applied, ignoring them until the serial is raised", name, p.Serial)
+		}
+		return false, nil
+	}
+	if name == mainProfile && GetConnectionState() != Disconnected {
+		return false, fmt.Errorf("profile %s is connected, disconnect to apply serial %d", name, p.Serial)
+	}
+	if IsTunnelRunning(name) {
+		return false, fmt.Errorf("profile %s is connected, disconnect to apply serial %d", name, p.Serial)
+	}
+
+	// The device identity belongs to the server it was registered with
+	serverChanged := c.ServerAddr != p.Profile.Server || c.Key != p.Profile.Key
+	applyProfileBundle(&c, &options, p.Profile)
+	options.ProvisioningURL = rawURL
+	options.ProvisioningKey = key
+	options.ProvisioningSerial = p.Serial
+	options.ProvisioningDigest = digest
+	if serverChanged {
+		if err := SyncServerSettings(&c, &options); err != nil {
+			return false, err
+		}
+		if err := RegisterDevice(&c, &options); err != nil {
+			return false, err
+		}
+	}
+	if err := SaveProfile(name, c, options); err != nil {
+		return false, err
+	}
+	if name == mainProfile {
+		provisionedMain.Lock()
+		provisionedMain.pending = true
+		provisionedMain.name, provisionedMain.config, provisionedMain.options = name, c, options
+		provisionedMain.Unlock()
+	}
+	log.Printf("Profile %s provisioned, serial %d", name, p.Serial)
+	return true, nil
+}
+
+// ApplyProvisionedProfile switches the main tunnel to the settings of its
+// profile provisioned in the background since, if any. It must be called
+// from the UI, which owns config.AppConfig and ClientOptions, while the
+// client is stopped.
+func ApplyProvisionedProfile() bool {
+	provisionedMain.Lock()
+	defer provisionedMain.Unlock()
+	if !provisionedMain.pending {
+		return false
+	}
+	provisionedMain.pending = false
+	if provisionedMain.name != mainProfile {
+		return false
+	}
+	config.AppConfig, ClientOptions = provisionedMain.config, provisionedMain.options
+	log.Printf("Using provisioned profile %s, serial %d", mainProfile, ClientOptions.ProvisioningSerial)
+	return true
+}
+
+// provisionDigest returns the SHA-256 of a provisioned profile.
+func provisionDigest(b ProfileBundle) (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// RunProvisioner checks the provisioning URL of each provisioned profile
+// every ProvisioningInterval. Connected profiles are updated once they are
+// disconnected.
+func RunProvisioner() {
+	for {
+		profiles, err := ListProfiles()
+		if err != nil {
+			log.Print(err)
+		}
+		for _, name := range profiles {
+			_, options, err := LoadProfile(name)
+			if err != nil {
+				continue
+			}
+			if options.ProvisioningURL == "" {
+				continue
+			}
+			interval := time.Duration(options.ProvisioningInterval) * time.Second
+			if interval <= 0 {
+				interval = time.Hour
+			}
+			if time.Since(lastProvisionCheck[name]) < interval {
+				continue
+			}
+			if IsTunnelRunning(name) || (name == mainProfile && GetConnectionState() != Disconnected) {
+				continue
+			}
+			lastProvisionCheck[name] = time.Now()
+			if _, err := Provision(name, options.ProvisioningURL, options.ProvisioningKey); err != nil {
+				log.Printf("Unable to provision profile %s: %v", name, err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+func TestVerifyProvision(t *testing.T) {
+	public, private, err := GenerateProvisioningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := GenerateProvisioningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProvisionedProfile{Serial: 3, Profile: testBundle()}
+	signed, err := SignProvision(p, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc provisionDocument
+	if err := json.Unmarshal(signed, &doc); err != nil {
+		t.Fatal(err)
+	}
+	unsigned, _ := json.Marshal(provisionDocument{Payload: doc.Payload})
+	tampered := doc
+	payload, _ := base64.StdEncoding.DecodeString(doc.Payload)
+	tampered.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(payload), `"serial":3`, `"serial":4`, 1)))
+	badSignature, _ := json.Marshal(tampered)
+
+	tests := []struct {
+		name string
+		data []byte
+		key  string
+		err  string
+	}{
+		{"signed", signed, public, ""},
+		{"bad signature", badSignature, public, "signature doesn't match"},
+		{"unsigned", unsigned, public, "isn't signed"},
+		{"wrong key", signed, otherPublic, "signature doesn't match"},
+		{"not json", []byte("serial: 3"), public, "invalid provisioning document"},
+	}
+	for _, tt := range tests {
+		key, err := ParseProvisioningKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := VerifyProvision(tt.data, key)
+		if tt.err == "" {
+			if err != nil || got.Serial != p.Serial || got.Profile.Server != p.Profile.Server {
+				t.Errorf("%s: VerifyProvision = %+v, %v", tt.name, got, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: VerifyProvision = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestProvision(t *testing.T) {
+	public, private, err := GenerateProvisioningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer server.Close()
+	client := provisionClient
+	provisionClient = server.Client()
+	root := profilesRoot
+	profilesRoot = t.TempDir()
+	main := mainProfile
+	mainProfile = "office"
+	savedConfig, savedOptions := config.AppConfig, ClientOptions
+	defer func() {
+		provisionClient, profilesRoot, mainProfile = client, root, main
+		config.AppConfig, ClientOptions = savedConfig, savedOptions
+	}()
+
+	// The profile was provisioned with serial 5
+	b := testBundle()
+	digest, err := provisionDigest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	options := DefaultOptions
+	applyProfileBundle(&c, &options, b)
+	options.ProvisioningURL, options.ProvisioningKey = server.URL, public
+	options.ProvisioningSerial, options.ProvisioningDigest = 5, digest
+	if err := SaveProfile("office", c, options); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := testBundle()
+	changed.IncludeRoutes = []string{"10.0.0.0/8", "192.168.0.0/16"}
+	tests := []struct {
+		name    string
+		url     string
+		serial  uint64
+		profile ProfileBundle
+		changed bool
+		err     string
+		// saved is the serial of the profile afterwards
+		saved uint64
+	}{
+		{"plain http", strings.Replace(server.URL, "https://", "http://", 1), 6, changed, false, "must be https", 5},
+		{"lower serial", server.URL, 4, changed, false, "serial 4 is lower than 5", 5},
+		{"same serial", server.URL, 5, b, false, "", 5},
+		{"reused serial", server.URL, 5, changed, false, "", 5},
+		{"higher serial", server.URL, 6, changed, true, "", 6},
+	}
+	for _, tt := range tests {
+		served, err = SignProvision(ProvisionedProfile{Serial: tt.serial, Profile: tt.profile}, private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := Provision("office", tt.url, public)
+		if ok != tt.changed || tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: Provision = %v, %v, want %v, %q", tt.name, ok, err, tt.changed, tt.err)
+		}
+		_, saved, err := LoadProfile("office")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.ProvisioningSerial != tt.saved {
+			t.Errorf("%s: saved serial %d, want %d", tt.name, saved.ProvisioningSerial, tt.saved)
+		}
+		if tt.saved == 5 && len(saved.IncludeRoutes) != len(b.IncludeRoutes) {
+			t.Errorf("%s: saved include routes %v, want %v", tt.name, saved.IncludeRoutes, b.IncludeRoutes)
+		}
+	}
+
+	// The main tunnel picks the update up from the UI
+	if !ApplyProvisionedProfile() {
+		t.Fatal("ApplyProvisionedProfile = false, want the update of serial 6")
+	}
+	if ClientOptions.ProvisioningSerial != 6 || len(ClientOptions.IncludeRoutes) != 2 {
+		t.Errorf("ClientOptions = serial %d, include routes %v", ClientOptions.ProvisioningSerial, ClientOptions.IncludeRoutes)
+	}
+	if ApplyProvisionedProfile() {
+		t.Error("ApplyProvisionedProfile applied the update twice")
+	}
+}
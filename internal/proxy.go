@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// contextDialer is satisfied by net.Dialer and tunnelDialer.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyServer serves the SOCKS5 and HTTP proxies of the userspace mode.
+type proxyServer struct {
+	dialer    contextDialer
+	listeners []net.Listener
+}
+
+// CheckProxyAddr validates the listen address of a proxy, empty meaning
+// disabled. The proxies have no authentication, so only loopback
+// addresses are allowed, or anyone on the LAN could reach into the VPN.
+func CheckProxyAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid proxy address: %v", err)
+	}
+	if !ap.Addr().IsLoopback() {
+		return fmt.Errorf("proxy address %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// startProxies listens on options.SOCKSAddr and options.HTTPProxyAddr,
+// each being disabled if empty.
+func startProxies(dialer contextDialer, options IClientOptions) (*proxyServer, error) {
+	for _, addr := range []string{options.SOCKSAddr, options.HTTPProxyAddr} {
+		if err := CheckProxyAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+	p := &proxyServer{dialer: dialer}
+	if options.SOCKSAddr != "" {
+		l, err := net.Listen("tcp", options.SOCKSAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.listeners = append(p.listeners, l)
+		go p.serve(l, p.handleSOCKS)
+		log.Printf("SOCKS5 proxy listening on %s", options.SOCKSAddr)
+	}
+	if options.HTTPProxyAddr != "" {
+		l, err := net.Listen("tcp", options.HTTPProxyAddr)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.listeners = append(p.listeners, l)
+		go p.serve(l, p.handleHTTP)
+		log.Printf("HTTP proxy listening on %s", options.HTTPProxyAddr)
+	}
+	return p, nil
+}
+
+func (p *proxyServer) serve(l net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+func (p *proxyServer) Close() {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+}
+
+func (p *proxyServer) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return p.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// SOCKS5 protocol values, see RFC 1928
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksConnect      = 1
+	socksAddrIPv4     = 1
+	socksAddrDomain   = 3
+	socksAddrIPv6     = 4
+	socksSucceeded    = 0
+	socksFailure      = 1
+	socksUnsupported  = 7
+	socksNoAcceptable = 0xff
+)
+
+// handleSOCKS serves a SOCKS5 client. Only the CONNECT command without
+// authentication is supported, the proxy being bound to loopback.
+func (p *proxyServer) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	r := bufio.NewReader(conn)
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil || method != socksNoAuth {
+		return
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil || request[0] != socksVersion {
+		return
+	}
+	addr, err := readSOCKSAddr(r, request[3])
+	if err != nil {
+		return
+	}
+	if request[1] != socksConnect {
+		writeSOCKSReply(conn, socksUnsupported, nil)
+		return
+	}
+	target, err := p.dial(addr)
+	if err != nil {
+		log.Printf("SOCKS5: %s: %v", addr, err)
+		writeSOCKSReply(conn, socksFailure, nil)
+		return
+	}
+	defer target.Close()
+	if err := writeSOCKSReply(conn, socksSucceeded, target.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	relay(&bufferedConn{Conn: conn, r: r}, target)
+}
+
+func readSOCKSAddr(r io.Reader, typ byte) (string, error) {
+	var host string
+	switch typ {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, 4)
+		if typ == socksAddrIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", typ)
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func writeSOCKSReply(w io.Writer, status byte, bound net.Addr) error {
+	reply := []byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			copy(reply[4:8], ip)
+		} else {
+			reply = append([]byte{socksVersion, status, 0, socksAddrIPv6}, addr.IP.To16()...)
+			reply = append(reply, 0, 0)
+		}
+		binary.BigEndian.PutUint16(reply[len(reply)-2:], uint16(addr.Port))
+	}
+	_, err := w.Write(reply)
+	return err
+}
+
+// handleHTTP serves an HTTP proxy client, tunneling CONNECT requests and
+// forwarding plain HTTP ones.
+func (p *proxyServer) handleHTTP(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	transport := &http.Transport{
+		DialContext:     p.dialer.DialContext,
+		IdleConnTimeout: 90 * time.Second,
+	}
+	defer transport.CloseIdleConnections()
+	for {
+		conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if req.Method == http.MethodConnect {
+			p.handleConnect(&bufferedConn{Conn: conn, r: r}, req.Host)
+			return
+		}
+		if !req.URL.IsAbs() {
+			writeHTTPError(conn, http.StatusBadRequest)
+			return
+		}
+		req.RequestURI = ""
+		removeHopHeaders(req.Header)
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			log.Printf("HTTP proxy: %s: %v", req.URL.Host, err)
+			writeHTTPError(conn, http.StatusBadGateway)
+			return
+		}
+		removeHopHeaders(res.Header)
+		err = res.Write(conn)
+		res.Body.Close()
+		if err != nil || req.Close || res.Close {
+			return
+		}
+	}
+}
+
+func (p *proxyServer) handleConnect(conn net.Conn, addr string) {
+	target, err := p.dial(addr)
+	if err != nil {
+		log.Printf("HTTP proxy: %s: %v", addr, err)
+		writeHTTPError(conn, http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	relay(conn, target)
+}
+
+func writeHTTPError(w io.Writer, status int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// relay copies data both ways between a and b until either side is done,
+// and returns the number of bytes sent from a to b and from b to a.
+func relay(a, b net.Conn) (int64, int64) {
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(a, b)
+		closeWrite(a)
+	}()
+	sent, _ = io.Copy(b, a)
+	closeWrite(b)
+	wg.Wait()
+	return sent, received
+}
+
+// closeWrite half-closes c if possible, so that the peer sees EOF.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	if bc, ok := c.(*bufferedConn); ok {
+		closeWrite(bc.Conn)
+		return
+	}
+	c.Close()
+}
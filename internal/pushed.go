@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"log"
+	"net/netip"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// PushedRoutes are routes delivered by the server, either in the
+// registration and /config responses or in-band as a "routes" control
+// message.
+type PushedRoutes struct {
+	Include []string `json:"routes,omitempty"`
+	Exclude []string `json:"excludeRoutes,omitempty"`
+}
+
+// MergeRoutes returns options with the routes pushed by the server merged
+// into the local include and exclude lists. Precedence, highest first:
+//
+//  1. local exclude rules
+//  2. local include rules
+//  3. server-pushed exclude rules
+//  4. server-pushed include rules
+//
+// A pushed prefix overlapping a local one is ignored, so local rules always
+// win, and a pushed include overlapping a pushed exclude is narrowed by it
+// as usual. Pushed prefixes that PlanRoutes would reject are ignored as
+// well, since the server's mistakes shouldn't prevent connecting: ones
+// nested in a wider pushed prefix of the same list and, with an include
+// list, excludes outside every include. Pushed routes are ignored
+// altogether unless AcceptServerRoutes is set.
+func MergeRoutes(options IClientOptions) IClientOptions {
+	if !options.AcceptServerRoutes {
+		return options
+	}
+	local := append(parseValid(options.IncludeRoutes), parseValid(options.ExcludeRoutes)...)
+	options.IncludeRoutes = append(append([]string{}, options.IncludeRoutes...),
+		dropNested(filterPushed(options.ServerRoutes.Include, local))...)
+	exclude := dropNested(filterPushed(options.ServerRoutes.Exclude, local))
+	if include := parseValid(options.IncludeRoutes); len(include) > 0 {
+		exclude = dropOutside(exclude, include)
+	}
+	options.ExcludeRoutes = append(append([]string{}, options.ExcludeRoutes...), exclude...)
+	return options
+}
+
+// filterPushed drops pushed prefixes that are invalid or overlap local ones.
+func filterPushed(pushed []string, local []netip.Prefix) []string {
+	accepted := []string{}
+	for _, cidr := range pushed {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Printf("ignoring pushed route %q: %v", cidr, err)
+			continue
+		}
+		p = p.Masked()
+		overlaps := false
+		for _, q := range local {
+			if p.Overlaps(q) {
+				log.Printf("ignoring pushed route %s: overlaps local rule %s", p, q)
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			accepted = append(accepted, p.String())
+		}
+	}
+	return accepted
+}
+
+// dropNested drops pushed prefixes inside, or equal to, another one of
+// the same list.
+func dropNested(cidrs []string) []string {
+	prefixes := parseValid(cidrs)
+	accepted := []string{}
+	for i, p := range prefixes {
+		nested := false
+		for j, q := range prefixes {
+			if (q.Bits() < p.Bits() && q.Contains(p.Addr())) || (q == p && j < i) {
+				log.Printf("ignoring pushed route %s: overlaps pushed route %s", p, q)
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			accepted = append(accepted, p.String())
+		}
+	}
+	return accepted
+}
+
+// dropOutside drops pushed excludes that don't narrow down any include.
+func dropOutside(cidrs []string, include []netip.Prefix) []string {
+	accepted := []string{}
+	for _, p := range parseValid(cidrs) {
+		if !narrowsAny(p, include) {
+			log.Printf("ignoring pushed route %s: not inside any included prefix", p)
+			continue
+		}
+		accepted = append(accepted, p.String())
+	}
+	return accepted
+}
+
+func parseValid(cidrs []string) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	for _, cidr := range cidrs {
+		if p, err := netip.ParsePrefix(cidr); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes
+}
+
+// refreshServerConfig fetches the routes and DNS configuration currently
+// pushed by the server. The previously saved ones are kept if the server
+// can't be reached.
+func refreshServerConfig(config config.Config) {
+	res, err := GetServerConfiguration(config)
+	if err != nil {
+		log.Printf("unable to refresh server configuration: %v", err)
+		return
+	}
+	ClientOptions.ServerRoutes = res.PushedRoutes
+	ClientOptions.ServerDNS = res.PushedDNS
+	if err := SaveOptionsFile(ClientOptions); err != nil {
+		log.Print(err)
+	}
+}
+
+func setPushedRoutes(routes PushedRoutes) {
+	ClientOptions.ServerRoutes = routes
+	if err := SaveOptionsFile(ClientOptions); err != nil {
+		log.Print(err)
+	}
+}
+
+// applyPushedDNS switches to the DNS configuration the server pushed
+// in-band.
+func applyPushedDNS(dns PushedDNS) {
+	ClientOptions.ServerDNS = dns
+	if err := SaveOptionsFile(ClientOptions); err != nil {
+		log.Print(err)
+	}
+	v, ok := cache.GetCache().Get("iface")
+	if !ok || ClientOptions.UserspaceStack {
+		return
+	}
+	revertDNS()
+	if err := applyDNS(v.(packetDevice).Name(), ClientOptions); err != nil {
+		log.Printf("unable to apply server DNS: %v", err)
+	}
+}
+
+// applyPushedRoutes reinstalls the static routes after the server pushed
+// new ones in-band. Switching between full and split tunnel takes effect
+// on the next connect.
+func applyPushedRoutes(routes PushedRoutes) {
+	split := IsSplitTunnel(MergeRoutes(ClientOptions))
+	setPushedRoutes(routes)
+	if _, ok := cache.GetCache().Get("iface"); !ok {
+		return
+	}
+	if IsSplitTunnel(MergeRoutes(ClientOptions)) != split {
+		log.Println("Server routes change the tunnel mode, reconnect to apply")
+	}
+	if err := reinstallRoutes(); err != nil {
+		log.Printf("unable to apply server routes: %v", err)
+		return
+	}
+	log.Println("Server routes applied")
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeRoutes(t *testing.T) {
+	tests := []struct {
+		name          string
+		accept        bool
+		include       []string
+		exclude       []string
+		pushed        PushedRoutes
+		mergedInclude []string
+		mergedExclude []string
+	}{
+		{"not accepted", false, []string{"10.0.0.0/8"}, nil, PushedRoutes{Include: []string{"172.16.0.0/12"}}, []string{"10.0.0.0/8"}, nil},
+		{"nothing pushed", true, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, PushedRoutes{}, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}},
+		{"pushed appended", true, []string{"10.0.0.0/8"}, nil, PushedRoutes{Include: []string{"172.16.0.0/12"}, Exclude: []string{"10.2.0.0/16"}},
+			[]string{"10.0.0.0/8", "172.16.0.0/12"}, []string{}},
+		{"pushed exclude narrows pushed include", true, nil, nil, PushedRoutes{Include: []string{"172.16.0.0/12"}, Exclude: []string{"172.17.0.0/16"}},
+			[]string{"172.16.0.0/12"}, []string{"172.17.0.0/16"}},
+		{"local include wins", true, []string{"172.17.0.0/16"}, nil, PushedRoutes{Include: []string{"172.16.0.0/12"}, Exclude: []string{"172.17.1.0/24"}},
+			[]string{"172.17.0.0/16"}, []string{}},
+		{"local exclude wins", true, nil, []string{"192.168.0.0/16"}, PushedRoutes{Include: []string{"192.168.1.0/24"}},
+			[]string{}, []string{"192.168.0.0/16"}},
+		{"nested and invalid pushed", true, nil, nil, PushedRoutes{Include: []string{"10.0.0.0/8", "10.1.0.0/16", "10.0.0.0/8", "nope", "172.16.0.1/12"}},
+			[]string{"10.0.0.0/8", "172.16.0.0/12"}, []string{}},
+		{"pushed exclude outside every include", true, []string{"10.0.0.0/8"}, nil, PushedRoutes{Include: []string{"172.16.0.0/12"}, Exclude: []string{"192.168.0.0/16", "172.17.0.0/16"}},
+			[]string{"10.0.0.0/8", "172.16.0.0/12"}, []string{"172.17.0.0/16"}},
+		{"full tunnel pushed exclude", true, nil, nil, PushedRoutes{Exclude: []string{"192.168.0.0/16"}},
+			[]string{}, []string{"192.168.0.0/16"}},
+	}
+	for _, tt := range tests {
+		options := DefaultOptions
+		options.AcceptServerRoutes = tt.accept
+		options.IncludeRoutes, options.ExcludeRoutes = tt.include, tt.exclude
+		options.ServerRoutes = tt.pushed
+		merged := MergeRoutes(options)
+		if !reflect.DeepEqual(merged.IncludeRoutes, tt.mergedInclude) || !reflect.DeepEqual(merged.ExcludeRoutes, tt.mergedExclude) {
+			t.Errorf("%s: MergeRoutes = %q, %q, want %q, %q", tt.name, merged.IncludeRoutes, merged.ExcludeRoutes, tt.mergedInclude, tt.mergedExclude)
+		}
+		// Whatever the server pushes, the merged lists can be planned
+		if _, err := PlanRoutes(merged, "tun0", "192.168.1.1"); err != nil {
+			t.Errorf("%s: PlanRoutes of the merged routes: %v", tt.name, err)
+		}
+	}
+}
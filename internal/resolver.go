@@ -0,0 +1,452 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QueryLogSize is the number of queries kept in the resolver query log.
+var QueryLogSize = 200
+
+// resolver is a local DNS forwarder. It relays queries to its upstreams,
+// typically through the tunnel, caches the responses for their TTL and
+// hands them to domainRoutes.
+type resolver struct {
+	udp       net.PacketConn
+	tcp       net.Listener
+	upstreams []upstream
+	routes    *domainRoutes
+	cache     *dnsCache
+}
+
+// QueryLogEntry describes a query answered by the resolver.
+type QueryLogEntry struct {
+	Time     time.Time
+	Name     string
+	Type     string
+	Upstream string
+	Cached   bool
+	Err      error
+	Duration time.Duration
+}
+
+// ResolverStats counts the queries answered by the resolver.
+type ResolverStats struct {
+	Queries uint64
+	Hits    uint64
+	Errors  uint64
+}
+
+// HitRate returns the share of queries answered from the cache.
+func (s ResolverStats) HitRate() float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Queries)
+}
+
+var (
+	resolverQueries uint64
+	resolverHits    uint64
+	resolverErrors  uint64
+
+	queryLog      []QueryLogEntry
+	queryLogMutex sync.Mutex
+)
+
+func GetResolverStats() ResolverStats {
+	return ResolverStats{
+		Queries: atomic.LoadUint64(&resolverQueries),
+		Hits:    atomic.LoadUint64(&resolverHits),
+		Errors:  atomic.LoadUint64(&resolverErrors),
+	}
+}
+
+// GetQueryLog returns the most recent queries, newest first.
+func GetQueryLog() []QueryLogEntry {
+	queryLogMutex.Lock()
+	defer queryLogMutex.Unlock()
+	entries := make([]QueryLogEntry, len(queryLog))
+	for i, e := range queryLog {
+		entries[len(queryLog)-1-i] = e
+	}
+	return entries
+}
+
+func logQuery(e QueryLogEntry) {
+	queryLogMutex.Lock()
+	defer queryLogMutex.Unlock()
+	queryLog = append(queryLog, e)
+	if len(queryLog) > QueryLogSize {
+		queryLog = queryLog[len(queryLog)-QueryLogSize:]
+	}
+}
+
+// startResolver listens on options.ResolverAddr over UDP and TCP.
+func startResolver(options IClientOptions, routes *domainRoutes) (*resolver, error) {
+	upstreams, err := resolverUpstreams(options)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", options.ResolverAddr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp", options.ResolverAddr)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	r := &resolver{
+		udp:       udp,
+		tcp:       tcp,
+		upstreams: upstreams,
+		routes:    routes,
+		cache:     newDNSCache(),
+	}
+	go r.serveUDP()
+	go r.serveTCP()
+	names := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		names[i] = u.String()
+	}
+	log.Printf("Resolver listening on %s, upstream %s", options.ResolverAddr, strings.Join(names, ", "))
+	return r, nil
+}
+
+// resolverUpstreams returns the configured upstreams, falling back to the
+// DNS servers pushed by the server and then to the system nameserver.
+func resolverUpstreams(options IClientOptions) ([]upstream, error) {
+	addrs := options.ResolverUpstreams
+	if len(addrs) == 0 {
+		addrs = options.ServerDNS.Servers
+	}
+	if len(addrs) == 0 {
+		ns, err := systemNameserver()
+		if err != nil {
+			return nil, err
+		}
+		addrs = []string{ns}
+	}
+	upstreams := []upstream{}
+	for _, addr := range addrs {
+		if isSelfUpstream(addr, options.ResolverAddr) {
+			return nil, fmt.Errorf("DNS upstream %s is the local resolver itself", addr)
+		}
+		u, err := parseUpstream(addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+func (r *resolver) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := r.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if response := r.resolve(query); response != nil {
+				r.udp.WriteTo(response, client)
+			}
+		}()
+	}
+}
+
+func (r *resolver) serveTCP() {
+	for {
+		conn, err := r.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				response := r.resolve(query)
+				if response == nil || writeTCPMessage(conn, response) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve answers query from the cache or the first upstream that
+// responds.
+func (r *resolver) resolve(query []byte) []byte {
+	start := time.Now()
+	atomic.AddUint64(&resolverQueries, 1)
+	entry := QueryLogEntry{Time: start}
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		atomic.AddUint64(&resolverErrors, 1)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		atomic.AddUint64(&resolverErrors, 1)
+		return nil
+	}
+	entry.Name = q.Name.String()
+	entry.Type = strings.TrimPrefix(q.Type.String(), "Type")
+
+	response := r.cache.get(q, header.ID)
+	if response != nil {
+		atomic.AddUint64(&resolverHits, 1)
+		entry.Cached = true
+	} else {
+		for _, u := range r.upstreams {
+			entry.Upstream = u.String()
+			if response, err = u.Exchange(query); err == nil {
+				break
+			}
+		}
+	}
+	entry.Duration = time.Since(start)
+	if err != nil {
+		atomic.AddUint64(&resolverErrors, 1)
+		entry.Err = err
+		logQuery(entry)
+		return nil
+	}
+	logQuery(entry)
+	if !entry.Cached {
+		r.cache.put(q, response)
+	}
+	// Cached answers are learned again to keep their routes alive
+	if r.routes != nil {
+		r.routes.learn(response)
+	}
+	return response
+}
+
+func (r *resolver) Close() {
+	r.udp.Close()
+	r.tcp.Close()
+	if r.routes != nil {
+		r.routes.Close()
+	}
+}
+
+// upstream is a DNS server queries are forwarded to.
+type upstream interface {
+	Exchange(query []byte) ([]byte, error)
+	String() string
+}
+
+// parseUpstream parses "udp://host[:port]", "tcp://host[:port]",
+// "https://host/path" (DNS over HTTPS) or a bare "host[:port]" (UDP).
+func parseUpstream(s string) (upstream, error) {
+	u, err := upstreamURL(s)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "53")
+	}
+	switch u.Scheme {
+	case "udp":
+		return udpUpstream(addr), nil
+	case "tcp":
+		return tcpUpstream(addr), nil
+	case "https":
+		return dohUpstream(u.String()), nil
+	}
+	return nil, fmt.Errorf("unsupported DNS upstream %q", s)
+}
+
+// CheckUpstreams reports the first upstream that can't be parsed.
+func CheckUpstreams(addrs []string) error {
+	for _, addr := range addrs {
+		if _, err := parseUpstream(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upstreamURL(s string) (*url.URL, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		s = net.JoinHostPort(addr.String(), "53")
+	}
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	return url.Parse(s)
+}
+
+// upstreamIP returns the address of upstream s if it is given as an IP.
+func upstreamIP(s string) (netip.Addr, bool) {
+	u, err := upstreamURL(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+type udpUpstream string
+
+func (u udpUpstream) String() string { return "udp://" + string(u) }
+
+func (u udpUpstream) Exchange(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", string(u), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+type tcpUpstream string
+
+func (u tcpUpstream) String() string { return "tcp://" + string(u) }
+
+func (u tcpUpstream) Exchange(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", string(u), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+type dohUpstream string
+
+func (u dohUpstream) String() string { return string(u) }
+
+var dohClient = &http.Client{Timeout: 5 * time.Second}
+
+func (u dohUpstream) Exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", string(u), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// resolvedResolvConf lists the DNS servers systemd-resolved forwards to,
+// behind its stub in /etc/resolv.conf.
+const resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, or of
+// the servers behind systemd-resolved, that isn't on loopback: a local
+// stub may be forwarding to the local resolver itself once the host DNS
+// is pointed at it.
+func systemNameserver() (string, error) {
+	for _, path := range []string{"/etc/resolv.conf", resolvedResolvConf} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			if addr, err := netip.ParseAddr(fields[1]); err == nil && !addr.IsLoopback() {
+				file.Close()
+				return fields[1], nil
+			}
+		}
+		file.Close()
+	}
+	return "", errors.New("no nameserver outside loopback found, set the resolver upstreams")
+}
+
+// isSelfUpstream reports whether upstream s is the local resolver
+// listening on resolverAddr, which would forward queries to itself.
+func isSelfUpstream(s string, resolverAddr string) bool {
+	u, err := upstreamURL(s)
+	if err != nil || u.Scheme == "https" {
+		return false
+	}
+	addr, ok := upstreamIP(s)
+	if !ok {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "53"
+	}
+	listen, err := netip.ParseAddrPort(resolverAddr)
+	if err != nil || strconv.Itoa(int(listen.Port())) != port {
+		return false
+	}
+	l := listen.Addr().Unmap()
+	return addr == l || (addr.IsLoopback() && (l.IsLoopback() || l.IsUnspecified()))
+}
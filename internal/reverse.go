@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// ReverseForward exposes Local, a loopback TCP service, to VPN peers on
+// Port of the client's tunnel address, like ssh -R.
+type ReverseForward struct {
+	Port  uint16
+	Local string
+}
+
+func (f ReverseForward) String() string {
+	return fmt.Sprintf("tunnel:%d -> %s", f.Port, f.Local)
+}
+
+// ParseReverseForwards parses one reverse forward per line in
+// "port local" form. A local address without host is on loopback, e.g.
+// "8080 3000". Only loopback services can be exposed.
+func ParseReverseForwards(text string) ([]ReverseForward, error) {
+	forwards := []ReverseForward{}
+	ports := map[uint16]bool{}
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid reverse forward on line %d: %q", i+1, line)
+		}
+		port, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port on line %d: %q", i+1, fields[0])
+		}
+		f := ReverseForward{Port: uint16(port), Local: fields[1]}
+		if !strings.Contains(f.Local, ":") {
+			f.Local = net.JoinHostPort("127.0.0.1", f.Local)
+		}
+		ap, err := netip.ParseAddrPort(f.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address on line %d: %v", i+1, err)
+		}
+		if !ap.Addr().IsLoopback() {
+			return nil, fmt.Errorf("local address %s on line %d is not a loopback address", f.Local, i+1)
+		}
+		if ports[f.Port] {
+			return nil, fmt.Errorf("port %d on line %d is already forwarded", f.Port, i+1)
+		}
+		ports[f.Port] = true
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// FormatReverseForwards is the inverse of ParseReverseForwards.
+func FormatReverseForwards(forwards []ReverseForward) string {
+	lines := make([]string, len(forwards))
+	for i, f := range forwards {
+		lines[i] = fmt.Sprintf("%d %s", f.Port, f.Local)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParsePeers parses the addresses and prefixes of the peers allowed to
+// connect to reverse forwards, e.g. "10.8.0.5" or "10.8.0.0/24".
+func ParsePeers(peers []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(peers))
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if addr, err := netip.ParseAddr(peer); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q", peer)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// InboundConn is a peer connection to a reverse forward.
+type InboundConn struct {
+	Forward ReverseForward
+	Peer    string
+	Since   time.Time
+	// Sent and Received count the bytes to and from the peer
+	Sent     int64
+	Received int64
+}
+
+// GetInboundConns returns the open connections to reverse forwards, the
+// oldest first.
+func GetInboundConns() []InboundConn {
+	v, ok := cache.GetCache().Get("reverseforwards")
+	if !ok {
+		return nil
+	}
+	return v.(*reverseForwardSet).conns()
+}
+
+// tunnelListener listens on the tunnel address, either through the tun
+// interface or inside the userspace stack.
+type tunnelListener interface {
+	ListenTCP(addr netip.AddrPort) (net.Listener, error)
+}
+
+// hostListener listens with the host stack, whose tun interface holds the
+// tunnel address.
+type hostListener struct{}
+
+func (hostListener) ListenTCP(addr netip.AddrPort) (net.Listener, error) {
+	return net.Listen("tcp", addr.String())
+}
+
+// reverseForwardSet runs the reverse forwards of a session.
+type reverseForwardSet struct {
+	sync.Mutex
+
+	peers     []netip.Prefix
+	listeners []net.Listener
+	inbound   map[net.Conn]*inboundConn
+}
+
+type inboundConn struct {
+	forward  ReverseForward
+	peer     string
+	since    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// startReverseForwards listens for peers on each tunnel address of the
+// session. A port that can't be listened on is logged and skipped.
+// Connections from peers outside options.ReverseForwardPeers are
+// refused, nobody being allowed if it's empty.
+func startReverseForwards(listener tunnelListener, config config.Config, options IClientOptions) (*reverseForwardSet, error) {
+	peers, err := ParsePeers(options.ReverseForwardPeers)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		log.Println("Reverse forwards: no peers are allowed to connect")
+	}
+	addrs := []netip.Addr{}
+	for _, cidr := range []string{config.CIDR, options.CIDRv6} {
+		if cidr == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, p.Addr())
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no tunnel address to listen on")
+	}
+	s := &reverseForwardSet{peers: peers, inbound: map[net.Conn]*inboundConn{}}
+	for _, f := range options.ReverseForwards {
+		for _, addr := range addrs {
+			l, err := listener.ListenTCP(netip.AddrPortFrom(addr, f.Port))
+			if err != nil {
+				// e.g. the IPv6 address is still tentative
+				log.Printf("reverse forward %s: %v", f, err)
+				continue
+			}
+			s.listeners = append(s.listeners, l)
+			go s.serve(l, f)
+			log.Printf("Exposing %s on %s", f.Local, l.Addr())
+		}
+	}
+	return s, nil
+}
+
+// allowed reports whether the peer at addr may connect.
+func (s *reverseForwardSet) allowed(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range s.peers {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *reverseForwardSet) serve(l net.Listener, f ReverseForward) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			log.Printf("reverse forward %s: refused %s", f, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go s.handle(conn, f)
+	}
+}
+
+func (s *reverseForwardSet) handle(conn net.Conn, f ReverseForward) {
+	defer conn.Close()
+	local, err := net.DialTimeout("tcp", f.Local, 10*time.Second)
+	if err != nil {
+		log.Printf("reverse forward %s: %v", f, err)
+		return
+	}
+	defer local.Close()
+	c := &inboundConn{forward: f, peer: conn.RemoteAddr().String(), since: time.Now()}
+	s.Lock()
+	s.inbound[conn] = c
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.inbound, conn)
+		s.Unlock()
+	}()
+	relay(&countingConn{Conn: conn, written: &c.sent, read: &c.received}, local)
+}
+
+func (s *reverseForwardSet) conns() []InboundConn {
+	s.Lock()
+	defer s.Unlock()
+	conns := []InboundConn{}
+	for _, c := range s.inbound {
+		conns = append(conns, InboundConn{
+			Forward:  c.forward,
+			Peer:     c.peer,
+			Since:    c.since,
+			Sent:     c.sent.Load(),
+			Received: c.received.Load(),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	return conns
+}
+
+func (s *reverseForwardSet) Close() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.Lock()
+	defer s.Unlock()
+	for conn := range s.inbound {
+		conn.Close()
+	}
+}
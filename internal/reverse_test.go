@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseReverseForwards(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		forwards []ReverseForward
+		err      bool
+	}{
+		{"empty", "\n", []ReverseForward{}, false},
+		{"port only", "8080 3000", []ReverseForward{{8080, "127.0.0.1:3000"}}, false},
+		{"loopback", "8080 127.0.0.2:3000\n\n2222 [::1]:22", []ReverseForward{{8080, "127.0.0.2:3000"}, {2222, "[::1]:22"}}, false},
+		{"not loopback", "8080 192.168.1.10:3000", nil, true},
+		{"wildcard", "8080 0.0.0.0:3000", nil, true},
+		{"host name", "8080 localhost:3000", nil, true},
+		{"port zero", "0 3000", nil, true},
+		{"port too large", "65536 3000", nil, true},
+		{"duplicate port", "8080 3000\n8080 3001", nil, true},
+		{"missing local", "8080", nil, true},
+	}
+	for _, tt := range tests {
+		forwards, err := ParseReverseForwards(tt.text)
+		if (err != nil) != tt.err || !tt.err && !reflect.DeepEqual(forwards, tt.forwards) {
+			t.Errorf("%s: ParseReverseForwards = %v, %v, want %v", tt.name, forwards, err, tt.forwards)
+		}
+		if err == nil {
+			if again, _ := ParseReverseForwards(FormatReverseForwards(forwards)); !reflect.DeepEqual(again, forwards) {
+				t.Errorf("%s: FormatReverseForwards doesn't round-trip: %v", tt.name, again)
+			}
+		}
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		peers    []string
+		prefixes []string
+		err      bool
+	}{
+		{[]string{}, []string{}, false},
+		{[]string{"10.8.0.5", " fd00::5 "}, []string{"10.8.0.5/32", "fd00::5/128"}, false},
+		{[]string{"10.8.0.0/24", "10.8.1.7/24"}, []string{"10.8.0.0/24", "10.8.1.0/24"}, false},
+		{[]string{"peer.example"}, nil, true},
+		{[]string{"10.8.0.0/33"}, nil, true},
+	}
+	for _, tt := range tests {
+		prefixes, err := ParsePeers(tt.peers)
+		if (err != nil) != tt.err {
+			t.Errorf("ParsePeers(%q) = %v, want error %v", tt.peers, err, tt.err)
+			continue
+		}
+		got := []string{}
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.prefixes) {
+			t.Errorf("ParsePeers(%q) = %v, want %v", tt.peers, got, tt.prefixes)
+		}
+	}
+	// A single address only allows that peer
+	prefixes, _ := ParsePeers([]string{"10.8.0.5"})
+	if prefixes[0].Contains(netip.MustParseAddr("10.8.0.6")) {
+		t.Error("peer 10.8.0.5 allows 10.8.0.6")
+	}
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+var errRoutesUnsupported = errors.New("route management is not supported on this platform")
+
+// Route is a route installed by the client. Routes without a gateway go
+// through the tun interface.
+type Route struct {
+	Prefix  netip.Prefix
+	Gateway string
+	Dev     string
+	// Table is the routing table, 0 meaning the main one
+	Table int
+	// Type is the route type, e.g. "unreachable", unicast if empty
+	Type string
+}
+
+func (r Route) String() string {
+	s := fmt.Sprintf("%s dev %s", r.Prefix, r.Dev)
+	if r.Gateway != "" {
+		s = fmt.Sprintf("%s via %s", r.Prefix, r.Gateway)
+		if r.Dev != "" {
+			s += " dev " + r.Dev
+		}
+	}
+	if r.Type != "" {
+		s = fmt.Sprintf("%s %s", r.Type, r.Prefix)
+	}
+	if r.Table != 0 {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// IsSplitTunnel reports whether only the included prefixes are routed
+// through the tunnel instead of all traffic.
+func IsSplitTunnel(options IClientOptions) bool {
+	return len(options.IncludeRoutes) > 0
+}
+
+// ParsePrefixes parses and validates a list of CIDR prefixes. Prefixes with
+// host bits set and prefixes overlapping each other are rejected.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		if p != p.Masked() {
+			return nil, fmt.Errorf("invalid prefix %s: host bits set, did you mean %s?", p, p.Masked())
+		}
+		for _, q := range prefixes {
+			if p.Overlaps(q) {
+				return nil, fmt.Errorf("prefix %s overlaps %s", p, q)
+			}
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// PlanRoutes computes the routes needed for the include and exclude lists.
+// Included prefixes go through dev, excluded ones through gateway (or
+// options.LocalGatewayV6 for IPv6). With an include list, every excluded
+// prefix must narrow down an included one. In full tunnel mode IPv6 is
+// routed through dev as well when the server assigned an IPv6 address, or
+// blocked if options.BlockIPv6 is set.
+func PlanRoutes(options IClientOptions, dev string, gateway string) ([]Route, error) {
+	include, err := ParsePrefixes(options.IncludeRoutes)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := ParsePrefixes(options.ExcludeRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []Route{}
+	if options.PolicyRouting && len(include) == 0 {
+		// The tunnel table replaces the default route of the main table
+		routes = append(routes, Route{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Dev: dev})
+	}
+	if len(include) == 0 {
+		routes = append(routes, planIPv6Routes(options, dev)...)
+	}
+	for _, p := range include {
+		routes = append(routes, Route{Prefix: p, Dev: dev})
+	}
+	for _, p := range exclude {
+		if len(include) > 0 && !narrowsAny(p, include) {
+			return nil, fmt.Errorf("excluded prefix %s is not inside any included prefix", p)
+		}
+		route := Route{Prefix: p, Gateway: gateway}
+		if p.Addr().Is6() {
+			route.Gateway, route.Dev = options.LocalGatewayV6, options.LocalGatewayV6Dev
+		}
+		if addr, err := netip.ParseAddr(route.Gateway); err != nil || addr.Is4() != p.Addr().Is4() {
+			return nil, fmt.Errorf("excluded prefix %s needs a local gateway of the same address family", p)
+		}
+		routes = append(routes, route)
+	}
+	if options.PolicyRouting {
+		for i := range routes {
+			routes[i].Table = options.RoutingTable
+		}
+	}
+	return routes, nil
+}
+
+// planIPv6Routes returns the full tunnel IPv6 routes. Like for IPv4, the
+// default route is overridden by two /1 routes unless policy routing is
+// used.
+func planIPv6Routes(options IClientOptions, dev string) []Route {
+	prefixes := []netip.Prefix{netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1")}
+	if options.PolicyRouting {
+		prefixes = []netip.Prefix{netip.MustParsePrefix("::/0")}
+	}
+	routes := []Route{}
+	for _, p := range prefixes {
+		switch {
+		case options.CIDRv6 != "":
+			routes = append(routes, Route{Prefix: p, Dev: dev})
+		case options.BlockIPv6:
+			// Applications fail fast and fall back to IPv4
+			routes = append(routes, Route{Prefix: p, Type: "unreachable"})
+		}
+	}
+	return routes
+}
+
+// narrowsAny reports whether p is strictly inside one of prefixes.
+func narrowsAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, q := range prefixes {
+		if q.Bits() < p.Bits() && q.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupRouting installs the client's own routes once the tun interface dev
+// is up.
+func setupRouting(dev string, config config.Config) error {
+	if routesSupported {
+		routes, err := planTunnelRoutes(dev, config.LocalGateway, config.ServerIP)
+		if err != nil {
+			return err
+		}
+		if ClientOptions.CIDRv6 != "" {
+			if err := addAddress(dev, ClientOptions.CIDRv6); err != nil {
+				return err
+			}
+		}
+		if err := installRoutes(routes); err != nil {
+			return err
+		}
+		if ClientOptions.PolicyRouting {
+			if err := addPolicyRules(ClientOptions); err != nil {
+				removeRoutes()
+				return err
+			}
+		}
+	} else if needsRoutes(ClientOptions) {
+		log.Printf("%v, only the routes of the tunnel are installed", errRoutesUnsupported)
+	}
+	if len(ClientOptions.DomainRoutes) > 0 || ClientOptions.DNSForwarder {
+		var domainRoutes *domainRoutes
+		if len(ClientOptions.DomainRoutes) > 0 && routesSupported {
+			domainRoutes = newDomainRoutes(ClientOptions.DomainRoutes, dev)
+		}
+		r, err := startResolver(ClientOptions, domainRoutes)
+		if err != nil {
+			if domainRoutes != nil {
+				domainRoutes.Close()
+			}
+			teardownRouting()
+			return err
+		}
+		cache.GetCache().Set("resolver", r, 24*time.Hour)
+	}
+	// The resolver found its upstreams before the host is pointed at it
+	if err := applyDNS(dev, ClientOptions); err != nil {
+		teardownRouting()
+		return err
+	}
+	return nil
+}
+
+// RoutesSupported reports whether the client can install its own routes
+// on this platform, which include and exclude lists, domain routes, policy
+// routing and IPv6 blocking need.
+func RoutesSupported() bool {
+	return routesSupported
+}
+
+// checkRouteOptions refuses local options the client can't honour without
+// route management, rather than connecting with a tunnel other than the
+// one asked for. Routes pushed by the server are only logged, see
+// setupRouting.
+func checkRouteOptions(options IClientOptions) error {
+	if routesSupported || options.UserspaceStack {
+		return nil
+	}
+	unsupported := []string{}
+	if len(options.IncludeRoutes) > 0 {
+		unsupported = append(unsupported, "include routes")
+	}
+	if len(options.ExcludeRoutes) > 0 {
+		unsupported = append(unsupported, "exclude routes")
+	}
+	if len(options.DomainRoutes) > 0 {
+		unsupported = append(unsupported, "domain routes")
+	}
+	if options.PolicyRouting {
+		unsupported = append(unsupported, "policy routing")
+	}
+	if options.BlockIPv6 {
+		unsupported = append(unsupported, "IPv6 blocking")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%v, turn off %s", errRoutesUnsupported, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// needsRoutes reports whether options ask for routes beyond the ones
+// xtun-core installs for the tunnel.
+func needsRoutes(options IClientOptions) bool {
+	merged := MergeRoutes(options)
+	return IsSplitTunnel(merged) || len(merged.ExcludeRoutes) > 0 || len(merged.DomainRoutes) > 0 ||
+		options.PolicyRouting || options.BlockIPv6 || options.CIDRv6 != "" || len(options.Forwards) > 0
+}
+
+// planTunnelRoutes returns the routes installed for the tunnel interface
+// dev, gateway being the local one and serverIP the server's tunnel address.
+func planTunnelRoutes(dev string, gateway string, serverIP string) ([]Route, error) {
+	routes, err := PlanRoutes(MergeRoutes(ClientOptions), dev, gateway)
+	if err != nil {
+		return nil, err
+	}
+	routes = append(routes, tunnelHostRoutes(ClientOptions, dev, routes)...)
+	if ClientOptions.TapMode {
+		routes = planTapRoutes(ClientOptions, routes, dev, serverIP)
+	}
+	return routes, nil
+}
+
+// tunnelHostRoutes sends the local resolver's upstreams and the targets
+// of port forwards through the tunnel in split tunnel mode. The system
+// nameserver, used when no upstream is configured or pushed, is left
+// alone.
+func tunnelHostRoutes(options IClientOptions, dev string, routes []Route) []Route {
+	if !IsSplitTunnel(MergeRoutes(options)) {
+		return nil
+	}
+	addrs := []string{}
+	if options.DNSForwarder || len(options.DomainRoutes) > 0 {
+		addrs = append(addrs, options.ResolverUpstreams...)
+		if len(addrs) == 0 {
+			addrs = append(addrs, options.ServerDNS.Servers...)
+		}
+	}
+	for _, f := range options.Forwards {
+		addrs = append(addrs, f.Remote)
+	}
+	hostRoutes := []Route{}
+	for _, s := range addrs {
+		addr, ok := upstreamIP(s)
+		if !ok || addr.IsLoopback() {
+			continue
+		}
+		host := Route{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Dev: dev}
+		if options.PolicyRouting {
+			host.Table = options.RoutingTable
+		}
+		if !containsRoute(routes, host) && !containsRoute(hostRoutes, host) {
+			hostRoutes = append(hostRoutes, host)
+		}
+	}
+	return hostRoutes
+}
+
+func containsRoute(routes []Route, r Route) bool {
+	for _, route := range routes {
+		if route.Prefix == r.Prefix && route.Table == r.Table {
+			return true
+		}
+	}
+	return false
+}
+
+// teardownRouting undoes setupRouting.
+func teardownRouting() {
+	revertDNS()
+	if v, ok := cache.GetCache().Get("resolver"); ok {
+		v.(*resolver).Close()
+		cache.GetCache().Delete("resolver")
+	}
+	removeRoutes()
+	if ClientOptions.PolicyRouting && routesSupported {
+		delPolicyRules(ClientOptions)
+	}
+}
+
+// reinstallRoutes replaces the routes installed by setupRouting, e.g.
+// after the pushed routes or the local gateway changed.
+func reinstallRoutes() error {
+	v, ok := cache.GetCache().Get("iface")
+	if !ok || ClientOptions.UserspaceStack || !routesSupported {
+		return nil
+	}
+	tunConfig, _ := getTunConfig()
+	routes, err := planTunnelRoutes(v.(packetDevice).Name(), getLocalGateway(), tunConfig.ServerIP)
+	if err != nil {
+		return err
+	}
+	return swapRoutes(routes)
+}
+
+// swapRoutes replaces the routes added by installRoutes with routes. New
+// routes are added before the ones no longer needed are removed, so the
+// tunnel keeps its routes if one can't be added.
+func swapRoutes(routes []Route) error {
+	old := []Route{}
+	if v, ok := cache.GetCache().Get("routes"); ok {
+		old = v.([]Route)
+	}
+	added := []Route{}
+	for _, r := range routes {
+		if hasRoute(old, r) {
+			continue
+		}
+		if err := applyRoute(r); err != nil {
+			for _, r := range added {
+				revertRoute(r)
+			}
+			return err
+		}
+		added = append(added, r)
+	}
+	for _, r := range old {
+		if hasRoute(routes, r) {
+			continue
+		}
+		if err := revertRoute(r); err != nil {
+			log.Print(err)
+		}
+	}
+	cache.GetCache().Set("routes", routes, 24*time.Hour)
+	return nil
+}
+
+func hasRoute(routes []Route, r Route) bool {
+	for _, route := range routes {
+		if route == r {
+			return true
+		}
+	}
+	return false
+}
+
+// installRoutes adds routes and records them so that removeRoutes can undo
+// them. Routes that were added are removed again if one fails.
+func installRoutes(routes []Route) error {
+	installed := []Route{}
+	for _, r := range routes {
+		if err := applyRoute(r); err != nil {
+			for _, r := range installed {
+				revertRoute(r)
+			}
+			return err
+		}
+		installed = append(installed, r)
+	}
+	cache.GetCache().Set("routes", installed, 24*time.Hour)
+	return nil
+}
+
+// removeRoutes deletes the routes added by installRoutes.
+func removeRoutes() {
+	v, ok := cache.GetCache().Get("routes")
+	if !ok {
+		return
+	}
+	for _, r := range v.([]Route) {
+		if err := revertRoute(r); err != nil {
+			log.Print(err)
+		}
+	}
+	cache.GetCache().Delete("routes")
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// routesSupported reports whether the client manages routes itself on
+// this platform. Elsewhere xtun-core installs the routes of the tunnel.
+const routesSupported = true
+
+func addRoute(r Route) error {
+	return execCmd("ip", routeArgs("add", r)...)
+}
+
+func delRoute(r Route) error {
+	return execCmd("ip", routeArgs("del", r)...)
+}
+
+func addAddress(dev string, cidr string) error {
+	return execCmd("ip", "addr", "add", cidr, "dev", dev)
+}
+
+func routeArgs(action string, r Route) []string {
+	args := []string{"route", action}
+	if r.Type != "" {
+		args = append(args, r.Type)
+	}
+	args = append(args, r.Prefix.String())
+	if r.Gateway != "" {
+		args = append(args, "via", r.Gateway)
+	}
+	if r.Dev != "" {
+		args = append(args, "dev", r.Dev)
+	}
+	if r.Table != 0 {
+		args = append(args, "table", strconv.Itoa(r.Table))
+	}
+	return args
+}
+
+// gatewayDev returns the interface of the IPv6 default route via gateway.
+func gatewayDev(gateway string) (string, error) {
+	out, err := exec.Command("ip", "-6", "route", "show", "default").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		via, dev := "", ""
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				via = fields[i+1]
+			case "dev":
+				dev = fields[i+1]
+			}
+		}
+		if via == gateway && dev != "" {
+			return dev, nil
+		}
+	}
+	return "", fmt.Errorf("no default route via %s", gateway)
+}
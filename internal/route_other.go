@@ -0,0 +1,21 @@
+//go:build !linux
+
+package internal
+
+const routesSupported = false
+
+func addRoute(r Route) error {
+	return errRoutesUnsupported
+}
+
+func delRoute(r Route) error {
+	return errRoutesUnsupported
+}
+
+func addAddress(dev string, cidr string) error {
+	return errRoutesUnsupported
+}
+
+func gatewayDev(gateway string) (string, error) {
+	return "", errRoutesUnsupported
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		cidrs []string
+		err   bool
+	}{
+		{[]string{}, false},
+		{[]string{"10.0.0.0/8", " 192.168.0.0/16 "}, false},
+		{[]string{"10.0.0.1/8"}, true},
+		{[]string{"10.0.0.0/8", "10.1.0.0/16"}, true},
+		{[]string{"10.0.0.0"}, true},
+	}
+	for _, tt := range tests {
+		if _, err := ParsePrefixes(tt.cidrs); (err != nil) != tt.err {
+			t.Errorf("ParsePrefixes(%q) = %v, want error %v", tt.cidrs, err, tt.err)
+		}
+	}
+}
+
+func TestPlanRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		routes  []string
+		err     bool
+	}{
+		{"full tunnel", nil, nil, []string{}, false},
+		{"include", []string{"10.0.0.0/8", "172.16.0.0/12"}, nil, []string{"10.0.0.0/8 dev tun0", "172.16.0.0/12 dev tun0"}, false},
+		{"exclude", nil, []string{"192.168.1.0/24"}, []string{"192.168.1.0/24 via 192.168.1.1"}, false},
+		{"exclude inside include", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, []string{"10.0.0.0/8 dev tun0", "10.1.0.0/16 via 192.168.1.1"}, false},
+		{"exclude outside include", []string{"10.0.0.0/8"}, []string{"192.168.1.0/24"}, nil, true},
+		{"exclude equal to include", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, nil, true},
+		{"invalid include", []string{"10.0.0.1/8"}, nil, nil, true},
+		{"invalid exclude", nil, []string{"nope"}, nil, true},
+	}
+	for _, tt := range tests {
+		options := DefaultOptions
+		options.IncludeRoutes, options.ExcludeRoutes = tt.include, tt.exclude
+		routes, err := PlanRoutes(options, "tun0", "192.168.1.1")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: PlanRoutes error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if got := routeStrings(routes); !tt.err && !reflect.DeepEqual(got, tt.routes) {
+			t.Errorf("%s: PlanRoutes = %v, want %v", tt.name, got, tt.routes)
+		}
+	}
+}
+
+func TestPlanIPv6Routes(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidrv6    string
+		block     bool
+		include   []string
+		exclude   []string
+		gatewayV6 string
+		routes    []string
+		err       bool
+	}{
+		{"ipv4 only server", "", false, nil, nil, "", []string{}, false},
+		{"tunnel ipv6", "fd00::2/64", false, nil, nil, "", []string{"::/1 dev tun0", "8000::/1 dev tun0"}, false},
+		{"block ipv6", "", true, nil, nil, "", []string{"unreachable ::/1", "unreachable 8000::/1"}, false},
+		{"tunnel ipv6 wins over blocking", "fd00::2/64", true, nil, nil, "", []string{"::/1 dev tun0", "8000::/1 dev tun0"}, false},
+		{"split tunnel leaves ipv6 alone", "fd00::2/64", true, []string{"10.0.0.0/8"}, nil, "", []string{"10.0.0.0/8 dev tun0"}, false},
+		{"exclude ipv6", "fd00::2/64", false, nil, []string{"2001:db8::/32"}, "fe80::1",
+			[]string{"::/1 dev tun0", "8000::/1 dev tun0", "2001:db8::/32 via fe80::1 dev eth0"}, false},
+		{"exclude ipv6 without gateway", "fd00::2/64", false, nil, []string{"2001:db8::/32"}, "", nil, true},
+		{"ipv4 gateway for ipv6", "fd00::2/64", false, nil, []string{"2001:db8::/32"}, "192.168.1.1", nil, true},
+	}
+	for _, tt := range tests {
+		options := DefaultOptions
+		options.CIDRv6, options.BlockIPv6 = tt.cidrv6, tt.block
+		options.IncludeRoutes, options.ExcludeRoutes = tt.include, tt.exclude
+		options.LocalGatewayV6, options.LocalGatewayV6Dev = tt.gatewayV6, "eth0"
+		routes, err := PlanRoutes(options, "tun0", "192.168.1.1")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: PlanRoutes error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if got := routeStrings(routes); !tt.err && !reflect.DeepEqual(got, tt.routes) {
+			t.Errorf("%s: PlanRoutes = %v, want %v", tt.name, got, tt.routes)
+		}
+	}
+}
+
+func TestCheckRouteOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*IClientOptions)
+		// refused is whether the options are refused without route
+		// management
+		refused bool
+	}{
+		{"defaults", func(o *IClientOptions) {}, false},
+		{"pushed routes", func(o *IClientOptions) { o.ServerRoutes.Include = []string{"10.0.0.0/8"} }, false},
+		{"include", func(o *IClientOptions) { o.IncludeRoutes = []string{"10.0.0.0/8"} }, true},
+		{"exclude", func(o *IClientOptions) { o.ExcludeRoutes = []string{"192.168.0.0/16"} }, true},
+		{"domains", func(o *IClientOptions) { o.DomainRoutes = []string{"internal.corp"} }, true},
+		{"policy routing", func(o *IClientOptions) { o.PolicyRouting = true }, true},
+		{"block ipv6", func(o *IClientOptions) { o.BlockIPv6 = true }, true},
+		{"userspace mode", func(o *IClientOptions) { o.UserspaceStack, o.IncludeRoutes = true, []string{"10.0.0.0/8"} }, false},
+	}
+	for _, tt := range tests {
+		options := DefaultOptions
+		tt.modify(&options)
+		err := checkRouteOptions(options)
+		if want := tt.refused && !routesSupported; (err != nil) != want {
+			t.Errorf("%s: checkRouteOptions = %v, want error %v", tt.name, err, want)
+		}
+	}
+}
+
+func routeStrings(routes []Route) []string {
+	s := []string{}
+	for _, r := range routes {
+		s = append(s, r.String())
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/xorgal/xtun-core/pkg/cache"
+)
+
+var errSleepUnsupported = errors.New("suspend detection is not supported on this platform")
+
+// SleepEvent is sent before the system goes to sleep and after it resumed.
+type SleepEvent struct {
+	// Sleep is true before sleeping and false after resuming
+	Sleep bool
+	// Ready, if set, must be called once the client is ready to sleep
+	Ready func()
+}
+
+// SleepNotifier delivers system sleep events until stop is closed.
+type SleepNotifier interface {
+	Notify(events chan<- SleepEvent, stop <-chan struct{}) error
+}
+
+// SleepEvents is the source of sleep events, systemd-logind on Linux. It
+// can be replaced to inject events.
+var SleepEvents SleepNotifier = systemSleepNotifier{}
+
+var (
+	resumed    chan struct{}
+	sleepStop  chan struct{}
+	sleepMutex sync.Mutex
+)
+
+// startSleepWatcher closes the connection before the system sleeps, since
+// it won't survive, and lets StartClient reconnect as soon as it resumed.
+func startSleepWatcher() {
+	stop := make(chan struct{})
+	sleepMutex.Lock()
+	sleepStop = stop
+	sleepMutex.Unlock()
+	events := make(chan SleepEvent)
+	go func() {
+		if err := SleepEvents.Notify(events, stop); err != nil {
+			log.Printf("suspend detection disabled: %v", err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case e := <-events:
+				handleSleepEvent(e)
+			}
+		}
+	}()
+}
+
+// stopSleepWatcher stops watching and releases a StartClient waiting for
+// the system to resume.
+func stopSleepWatcher() {
+	sleepMutex.Lock()
+	if sleepStop != nil {
+		close(sleepStop)
+		sleepStop = nil
+	}
+	sleepMutex.Unlock()
+	setSleeping(false)
+}
+
+func handleSleepEvent(e SleepEvent) {
+	if e.Sleep {
+		log.Println("System is going to sleep, closing connection...")
+		setSleeping(true)
+		closeSession()
+	} else {
+		log.Println("System resumed, reconnecting...")
+		setSleeping(false)
+	}
+	if e.Ready != nil {
+		e.Ready()
+	}
+}
+
+func setSleeping(sleeping bool) {
+	sleepMutex.Lock()
+	defer sleepMutex.Unlock()
+	if sleeping && resumed == nil {
+		resumed = make(chan struct{})
+	}
+	if !sleeping && resumed != nil {
+		close(resumed)
+		resumed = nil
+	}
+}
+
+// waitResume blocks while the system is sleeping.
+func waitResume() {
+	sleepMutex.Lock()
+	ch := resumed
+	sleepMutex.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+// closeSession tells the server that the connections are going away and
+// closes them.
+func closeSession() {
+	if v, ok := cache.GetCache().Get("streams"); ok {
+		v.(*streamSet).closeConns()
+	}
+	if conn := getWsConn(); conn != nil {
+		wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, ""))
+		conn.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// systemSleepNotifier listens to the PrepareForSleep signal of
+// systemd-logind. It holds a delay inhibitor lock, so that the system
+// waits for the connection to be closed before sleeping.
+type systemSleepNotifier struct{}
+
+func (systemSleepNotifier) Notify(events chan<- SleepEvent, stop <-chan struct{}) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath("/org/freedesktop/login1"),
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+	manager := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+
+	lock := inhibitSleep(manager)
+	defer func() { releaseSleep(lock) }()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case sig, ok := <-signals:
+			if !ok {
+				return errors.New("D-Bus connection closed")
+			}
+			if sig.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(sig.Body) != 1 {
+				continue
+			}
+			start, _ := sig.Body[0].(bool)
+			e := SleepEvent{Sleep: start}
+			if start {
+				held := lock
+				lock = nil
+				e.Ready = func() { releaseSleep(held) }
+			} else {
+				lock = inhibitSleep(manager)
+			}
+			select {
+			case events <- e:
+			case <-stop:
+				if e.Ready != nil {
+					e.Ready()
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// inhibitSleep takes a delay inhibitor lock, which is held until the
+// returned file is closed.
+func inhibitSleep(manager dbus.BusObject) *os.File {
+	var fd dbus.UnixFD
+	err := manager.Call("org.freedesktop.login1.Manager.Inhibit", 0,
+		"sleep", "xtun-client", "Closing the tunnel connection", "delay").Store(&fd)
+	if err != nil {
+		log.Printf("unable to take sleep inhibitor lock: %v", err)
+		return nil
+	}
+	return os.NewFile(uintptr(fd), "inhibitor")
+}
+
+func releaseSleep(lock *os.File) {
+	if lock != nil {
+		lock.Close()
+	}
+}
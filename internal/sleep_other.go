@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internal
+
+type systemSleepNotifier struct{}
+
+func (systemSleepNotifier) Notify(events chan<- SleepEvent, stop <-chan struct{}) error {
+	return errSleepUnsupported
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtun-core/pkg/cache"
+)
+
+// fakeSleepNotifier delivers the events sent on its channel.
+type fakeSleepNotifier struct {
+	events chan SleepEvent
+}
+
+func (n fakeSleepNotifier) Notify(events chan<- SleepEvent, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e := <-n.events:
+			events <- e
+		}
+	}
+}
+
+func TestSleepWatcher(t *testing.T) {
+	notifier := fakeSleepNotifier{events: make(chan SleepEvent)}
+	saved := SleepEvents
+	SleepEvents = notifier
+	defer func() { SleepEvents = saved }()
+	client, server := net.Pipe()
+	defer server.Close()
+	cache.GetCache().Set("wsconn", client, time.Minute)
+	defer cache.GetCache().Delete("wsconn")
+
+	startSleepWatcher()
+	defer stopSleepWatcher()
+
+	// The connection is torn down before the system sleeps
+	frames := make(chan ws.OpCode, 1)
+	go func() {
+		header, err := ws.ReadHeader(server)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, server)
+		frames <- header.OpCode
+	}()
+	ready := make(chan struct{})
+	notifier.events <- SleepEvent{Sleep: true, Ready: func() { close(ready) }}
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("sleep event not acknowledged")
+	}
+	select {
+	case op := <-frames:
+		if op != ws.OpClose {
+			t.Errorf("got frame %v before sleeping, want a close frame", op)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed before sleeping")
+	}
+
+	// The client waits for the system to wake up before reconnecting
+	woken := make(chan struct{})
+	go func() {
+		waitResume()
+		close(woken)
+	}()
+	select {
+	case <-woken:
+		t.Fatal("waitResume returned while sleeping")
+	case <-time.After(50 * time.Millisecond):
+	}
+	notifier.events <- SleepEvent{Sleep: false}
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatal("waitResume still blocked after resuming")
+	}
+}
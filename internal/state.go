@@ -3,11 +3,14 @@ package internal
 type IAppState struct {
 	SyncDeviceSettings bool
 	IsInitialized      bool
+	// DefaultProfile is the profile used by the main tunnel
+	DefaultProfile string
 }
 
 var DefaultState = IAppState{
 	SyncDeviceSettings: true,
 	IsInitialized:      false,
+	DefaultProfile:     DefaultProfileName,
 }
 
 var AppState IAppState
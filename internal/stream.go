@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// streamSet holds the extra ws connections opened alongside the primary
+// one. Packets are spread over all streams by flow hash so that a given
+// flow always uses the same stream and stays ordered.
+type streamSet struct {
+	sync.Mutex
+
+	conns []net.Conn
+	stop  chan struct{}
+	// moves carries the server address of a migration to each stream
+	moves []chan string
+}
+
+// startStreams opens n extra streams and keeps replacing the ones that die
+// until the set is closed.
+func startStreams(config config.Config, iface packetDevice, n int) *streamSet {
+	set := &streamSet{
+		conns: make([]net.Conn, n),
+		stop:  make(chan struct{}),
+		moves: make([]chan string, n),
+	}
+	for i := 0; i < n; i++ {
+		set.moves[i] = make(chan string, 1)
+		go set.run(config, iface, i)
+	}
+	return set
+}
+
+// run maintains stream i: it dials, pumps ws to tun, pings to detect a dead
+// connection and redials after a failure. On migration, the replacement
+// is dialed before the current connection is drained.
+func (s *streamSet) run(config config.Config, iface packetDevice, i int) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		waitResume()
+		if addr := GetActiveEndpoint(); addr != "" {
+			config.ServerAddr = addr
+		}
+		conn, err := connect(config)
+		if err != nil {
+			log.Printf("stream %d: %v", i+1, err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		s.set(i, conn)
+		go wsToTun(config, conn, iface)
+		for {
+			addr, ok := s.keepalive(conn, i)
+			if !ok {
+				break
+			}
+			next := config
+			next.ServerAddr = addr
+			replacement, err := connect(next)
+			if err != nil {
+				log.Printf("stream %d: unable to migrate: %v", i+1, err)
+				continue
+			}
+			config = next
+			s.set(i, replacement)
+			go wsToTun(config, replacement, iface)
+			go drain(conn)
+			conn = replacement
+		}
+		s.set(i, nil)
+		conn.Close()
+		log.Printf("stream %d: connection lost, replacing", i+1)
+	}
+}
+
+// keepalive pings conn until it fails or the set is closed, or returns
+// the server address to migrate stream i to.
+func (s *streamSet) keepalive(conn net.Conn, i int) (string, bool) {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return "", false
+		case addr := <-s.moves[i]:
+			return addr, true
+		case <-ticker.C:
+		}
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte("ping")); err != nil {
+			return "", false
+		}
+	}
+}
+
+// migrate moves every stream to the server at addr, see
+// MigrateConnection. A stream that is down redials there anyway.
+func (s *streamSet) migrate(addr string) {
+	for _, moves := range s.moves {
+		// Only the latest migration matters
+		select {
+		case <-moves:
+		default:
+		}
+		select {
+		case moves <- addr:
+		default:
+		}
+	}
+}
+
+func (s *streamSet) set(i int, conn net.Conn) {
+	s.Lock()
+	s.conns[i] = conn
+	s.Unlock()
+}
+
+// pick returns the stream for the flow of packet. The primary connection
+// takes the flow's share as well as the flows of dead streams.
+func (s *streamSet) pick(packet []byte) net.Conn {
+	if ClientOptions.TapMode {
+		// Frames of other protocols than IP stay on the primary connection
+		packet = framePayload(packet)
+	}
+	i := int(flowHash(packet) % uint32(len(s.conns)+1))
+	if i > 0 {
+		s.Lock()
+		conn := s.conns[i-1]
+		s.Unlock()
+		if conn != nil {
+			return conn
+		}
+	}
+	return getWsConn()
+}
+
+func (s *streamSet) Close() {
+	close(s.stop)
+	s.closeConns()
+}
+
+// closeConns closes the current streams, which are then replaced.
+func (s *streamSet) closeConns() {
+	s.Lock()
+	defer s.Unlock()
+	for i, conn := range s.conns {
+		if conn != nil {
+			conn.Close()
+			s.conns[i] = nil
+		}
+	}
+}
+
+// pickWsConn returns the connection packet should be sent on.
+func pickWsConn(packet []byte) net.Conn {
+	if v, ok := cache.GetCache().Get("streams"); ok {
+		return v.(*streamSet).pick(packet)
+	}
+	return getWsConn()
+}
+
+// flowHash hashes the protocol, addresses and ports of an IP packet.
+func flowHash(packet []byte) uint32 {
+	h := fnv.New32a()
+	if len(packet) == 0 {
+		return 0
+	}
+	var proto byte
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return 0
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		proto = packet[9]
+		h.Write(packet[12:20])
+		if len(packet) > ihl {
+			l4 = packet[ihl:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return 0
+		}
+		proto = packet[6]
+		h.Write(packet[8:40])
+		l4 = packet[40:]
+	default:
+		return 0
+	}
+	h.Write([]byte{proto})
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		h.Write(l4[:4])
+	}
+	return h.Sum32()
+}
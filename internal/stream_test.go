@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+)
+
+// testPacket returns an IP packet of proto between src and dst, with the
+// ports in front of payload.
+func testPacket(src, dst string, proto byte, sport, dport uint16, payload string) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	var packet []byte
+	if s.Is4() {
+		packet = make([]byte, 20)
+		packet[0] = 0x45
+		packet[9] = proto
+		copy(packet[12:16], s.AsSlice())
+		copy(packet[16:20], d.AsSlice())
+	} else {
+		packet = make([]byte, 40)
+		packet[0] = 0x60
+		packet[6] = proto
+		copy(packet[8:24], s.AsSlice())
+		copy(packet[24:40], d.AsSlice())
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, sport)
+	binary.BigEndian.PutUint16(ports[2:], dport)
+	return append(append(packet, ports...), payload...)
+}
+
+func TestFlowHash(t *testing.T) {
+	flow := testPacket("10.0.0.2", "10.0.0.1", 6, 40000, 443, "hello")
+	tests := []struct {
+		name   string
+		packet []byte
+		same   bool
+	}{
+		{"other payload", testPacket("10.0.0.2", "10.0.0.1", 6, 40000, 443, "world"), true},
+		{"other source port", testPacket("10.0.0.2", "10.0.0.1", 6, 40001, 443, "hello"), false},
+		{"other destination", testPacket("10.0.0.2", "10.0.0.3", 6, 40000, 443, "hello"), false},
+		{"other protocol", testPacket("10.0.0.2", "10.0.0.1", 17, 40000, 443, "hello"), false},
+		{"ipv6", testPacket("fd00::2", "fd00::1", 6, 40000, 443, "hello"), false},
+	}
+	for _, tt := range tests {
+		if same := flowHash(tt.packet) == flowHash(flow); same != tt.same {
+			t.Errorf("%s: same hash = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+
+	// Other protocols only hash the addresses
+	icmp := testPacket("10.0.0.2", "10.0.0.1", 1, 1, 2, "")
+	if flowHash(icmp) != flowHash(testPacket("10.0.0.2", "10.0.0.1", 1, 3, 4, "")) {
+		t.Error("the hash of an ICMP packet depends on its payload")
+	}
+	for _, packet := range [][]byte{nil, {0x45, 0}, make([]byte, 30), {0x60}} {
+		if h := flowHash(packet); h != 0 {
+			t.Errorf("flowHash(%x) = %d, want 0", packet, h)
+		}
+	}
+}
+
+func TestPickWsConn(t *testing.T) {
+	primary, primaryPeer := net.Pipe()
+	defer primary.Close()
+	defer primaryPeer.Close()
+	cache.GetCache().Set("wsconn", primary, time.Minute)
+	defer cache.GetCache().Delete("wsconn")
+
+	// Without streams every packet goes over the primary connection
+	packet := testPacket("10.0.0.2", "10.0.0.1", 6, 40000, 443, "")
+	if conn := pickWsConn(packet); conn != primary {
+		t.Fatal("pickWsConn didn't pick the primary connection without streams")
+	}
+
+	set := &streamSet{conns: make([]net.Conn, 3)}
+	for i := range set.conns {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		set.conns[i] = conn
+	}
+	cache.GetCache().Set("streams", set, time.Minute)
+	defer cache.GetCache().Delete("streams")
+	picked := map[net.Conn]bool{}
+	for port := uint16(40000); port < 40100; port++ {
+		packet := testPacket("10.0.0.2", "10.0.0.1", 6, port, 443, "")
+		conn := pickWsConn(packet)
+		if again := pickWsConn(testPacket("10.0.0.2", "10.0.0.1", 6, port, 443, "more")); again != conn {
+			t.Fatalf("port %d: a flow moved to another stream", port)
+		}
+		picked[conn] = true
+	}
+	if len(picked) != 4 {
+		t.Errorf("100 flows used %d of 4 connections", len(picked))
+	}
+
+	// The flows of a dead stream fall back to the primary connection
+	set.conns[0], set.conns[1], set.conns[2] = nil, nil, nil
+	if conn := pickWsConn(packet); conn != primary {
+		t.Error("pickWsConn didn't fall back to the primary connection")
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/cache"
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// In TAP mode the client exchanges Ethernet frames with the server instead
+// of IP packets, so that broadcasts, ARP and non-IP protocols cross the
+// VPN. The server must advertise support for it in /config.
+
+// EthernetHeaderLen is the size of the Ethernet header carried in front of
+// each packet in TAP mode.
+const EthernetHeaderLen = 14
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+)
+
+// TapMTU returns the MTU of the TAP interface, which leaves room for the
+// Ethernet header within the server's MTU.
+func TapMTU(mtu int) int {
+	return mtu - EthernetHeaderLen
+}
+
+// tapMAC returns the MAC address of the TAP interface of options. It is
+// generated once and saved to the main profile, so that the server and
+// peers keep seeing the same address across reconnects. options aren't
+// changed, see PrepareTapMAC.
+func tapMAC(options IClientOptions) (string, error) {
+	if options.TapMAC != "" {
+		if _, err := net.ParseMAC(options.TapMAC); err != nil {
+			return "", fmt.Errorf("invalid TAP MAC address: %v", err)
+		}
+		return options.TapMAC, nil
+	}
+	c, saved, err := LoadProfile(mainProfile)
+	if err == nil && saved.TapMAC != "" {
+		// Generated by a connect the UI didn't pick up yet
+		return tapMAC(IClientOptions{TapMAC: saved.TapMAC})
+	}
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return "", err
+	}
+	// Locally administered unicast
+	mac[0] = mac[0]&0xfe | 0x02
+	if err == nil {
+		saved.TapMAC = mac.String()
+		err = SaveProfile(mainProfile, c, saved)
+	}
+	if err != nil {
+		log.Printf("Unable to save the TAP MAC address: %v", err)
+	}
+	return mac.String(), nil
+}
+
+// PrepareTapMAC sets the MAC address of the TAP interface of the main
+// profile, generating it if needed. Like ApplyProvisionedProfile it must
+// be called by the owner of ClientOptions before StartClient, so that
+// saving the options later keeps the address.
+func PrepareTapMAC() error {
+	if !ClientOptions.TapMode {
+		return nil
+	}
+	mac, err := tapMAC(ClientOptions)
+	if err != nil {
+		return err
+	}
+	ClientOptions.TapMAC = mac
+	return nil
+}
+
+// sessionTapMAC returns the MAC address the client announces, set by
+// StartClient before any connection is dialed.
+func sessionTapMAC() string {
+	if v, ok := cache.GetCache().Get("tapmac"); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// createTap creates the TAP interface and sets up routing for it.
+func createTap(config config.Config) (packetDevice, error) {
+	res, err := GetServerConfiguration(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to negotiate TAP mode: %v", err)
+	}
+	if !res.TAP {
+		return nil, errors.New("the server does not support TAP mode")
+	}
+	mac := sessionTapMAC()
+	iface, err := openTap(config.DeviceName, mac, TapMTU(config.MTU), config.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupRouting(iface.Name(), config); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	cache.GetCache().Set("tunconfig", config, 24*time.Hour)
+	log.Printf("TAP interface %s up with address %s", iface.Name(), mac)
+	return iface, nil
+}
+
+// planTapRoutes adapts the tunnel routes to an Ethernet link: they go
+// through the server's tunnel address instead of being on-link, and the
+// full tunnel routes usually added by xtun-core are added here.
+func planTapRoutes(options IClientOptions, routes []Route, dev string, serverIP string) []Route {
+	if !IsSplitTunnel(MergeRoutes(options)) && !options.PolicyRouting {
+		routes = append([]Route{
+			{Prefix: netip.MustParsePrefix("0.0.0.0/1"), Dev: dev},
+			{Prefix: netip.MustParsePrefix("128.0.0.0/1"), Dev: dev},
+		}, routes...)
+	}
+	gateway := strings.Split(serverIP, "/")[0]
+	gatewayV6 := strings.Split(options.ServerIPv6, "/")[0]
+	for i, r := range routes {
+		if r.Dev != dev || r.Type != "" || r.Gateway != "" {
+			continue
+		}
+		if r.Prefix.Addr().Is4() {
+			routes[i].Gateway = gateway
+		} else {
+			routes[i].Gateway = gatewayV6
+		}
+	}
+	return routes
+}
+
+// framePayload returns the IP packet carried by an Ethernet frame, or nil
+// for other protocols.
+func framePayload(frame []byte) []byte {
+	if len(frame) < EthernetHeaderLen {
+		return nil
+	}
+	offset := 12
+	etherType := binary.BigEndian.Uint16(frame[offset:])
+	if etherType == etherTypeVLAN {
+		offset += 4
+		if len(frame) < offset+2 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[offset:])
+	}
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil
+	}
+	return frame[offset+2:]
+}
@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"strconv"
+
+	"github.com/net-byte/water"
+)
+
+// openTap creates the TAP interface name with the given MAC address, MTU
+// and IPv4 address, and brings it up.
+func openTap(name string, mac string, mtu int, cidr string) (packetDevice, error) {
+	iface, err := water.New(water.Config{
+		DeviceType:             water.TAP,
+		PlatformSpecificParams: water.PlatformSpecificParams{Name: name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := execCmd("ip", "link", "set", "dev", iface.Name(), "address", mac, "mtu", strconv.Itoa(mtu), "up"); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	if err := addAddress(iface.Name(), cidr); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	return iface, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+func openTap(name string, mac string, mtu int, cidr string) (packetDevice, error) {
+	return nil, errors.New("TAP mode is only supported on Linux")
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTapMAC(t *testing.T) {
+	root := profilesRoot
+	profilesRoot = t.TempDir()
+	main := mainProfile
+	mainProfile = "office"
+	defer func() { profilesRoot, mainProfile = root, main }()
+	options := DefaultOptions
+	options.TapMode = true
+	if err := SaveProfile("office", DefaultConfig(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		mac  string
+		err  bool
+	}{
+		{"set", "02:00:5e:10:00:01", false},
+		{"invalid", "02:00:5e", true},
+	}
+	for _, tt := range tests {
+		options.TapMAC = tt.mac
+		mac, err := tapMAC(options)
+		if (err != nil) != tt.err || !tt.err && mac != tt.mac {
+			t.Errorf("%s: tapMAC = %s, %v", tt.name, mac, err)
+		}
+	}
+
+	// A generated address is saved to the profile and reused by the next
+	// connect, even though the options passed in don't hold it
+	options.TapMAC = ""
+	mac, err := tapMAC(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := net.ParseMAC(mac)
+	if err != nil || addr[0]&0x03 != 0x02 {
+		t.Errorf("tapMAC = %s, want a locally administered unicast address", mac)
+	}
+	if again, err := tapMAC(options); err != nil || again != mac {
+		t.Errorf("tapMAC = %s, %v, want the saved %s", again, err, mac)
+	}
+	if _, saved, err := LoadProfile("office"); err != nil || saved.TapMAC != mac {
+		t.Errorf("saved TapMAC = %s, %v, want %s", saved.TapMAC, err, mac)
+	}
+}
@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtun-core/pkg/counter"
+)
+
+// The main tunnel runs in the app process. Each profile connected at the
+// same time runs in its own tunnel process, started with the "tunnel"
+// command, so that it has its own state, routes and counters. The process
+// reports its status as JSON lines on stdout and disconnects once its
+// stdin is closed.
+
+// TunnelStopTimeout is how long a tunnel process is given to undo its
+// network changes before it is killed.
+var TunnelStopTimeout = 15 * time.Second
+
+// TunnelStatus is the status of a tunnel. Profile is empty for the main
+// tunnel.
+type TunnelStatus struct {
+	Profile      string
+	State        ConnectionState
+	Server       string
+	Device       string
+	Address      string
+	ReadBytes    uint64
+	WrittenBytes uint64
+	// Error is the last connection error
+	Error string
+}
+
+// tunnelSpec is what conflict detection knows about a tunnel.
+type tunnelSpec struct {
+	name    string
+	config  config.Config
+	options IClientOptions
+}
+
+type tunnelProcess struct {
+	sync.Mutex
+
+	spec   tunnelSpec
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	done   chan struct{}
+	status TunnelStatus
+}
+
+var (
+	tunnels      = map[string]*tunnelProcess{}
+	tunnelsMutex sync.Mutex
+)
+
+// IsTunnelRunning reports whether the tunnel process of a profile is
+// running.
+func IsTunnelRunning(name string) bool {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	_, ok := tunnels[name]
+	return ok
+}
+
+// StartTunnel connects a profile alongside the main tunnel, unless it
+// conflicts with a tunnel already connected.
+func StartTunnel(name string) error {
+	if name == mainProfile {
+		return fmt.Errorf("profile %s is used by the main tunnel", name)
+	}
+	c, options, err := LoadProfile(name)
+	if err != nil {
+		return err
+	}
+	spec := tunnelSpec{name: name, config: c, options: options}
+	if err := checkConflicts(spec); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "tunnel", name)
+	cmd.Stderr = &prefixLogger{prefix: fmt.Sprintf("[%s] ", name)}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if _, ok := tunnels[name]; ok {
+		return fmt.Errorf("profile %s is already connected", name)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t := &tunnelProcess{
+		spec:   spec,
+		cmd:    cmd,
+		stdin:  stdin,
+		done:   make(chan struct{}),
+		status: TunnelStatus{Profile: name, State: Connecting, Server: c.ServerAddr, Device: c.DeviceName},
+	}
+	tunnels[name] = t
+	go t.readStatus(stdout)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Printf("[%s] tunnel process exited: %v", name, err)
+		}
+		close(t.done)
+		tunnelsMutex.Lock()
+		delete(tunnels, name)
+		tunnelsMutex.Unlock()
+	}()
+	return nil
+}
+
+func (t *tunnelProcess) readStatus(r io.Reader) {
+	decoder := json.NewDecoder(r)
+	for {
+		var status TunnelStatus
+		if err := decoder.Decode(&status); err != nil {
+			return
+		}
+		t.Lock()
+		t.status = status
+		t.Unlock()
+	}
+}
+
+// StopTunnel disconnects a profile, killing its process if it doesn't
+// exit in time.
+func StopTunnel(name string) error {
+	tunnelsMutex.Lock()
+	t, ok := tunnels[name]
+	tunnelsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	t.Lock()
+	t.status.State = Disconnecting
+	t.Unlock()
+	t.stdin.Close()
+	select {
+	case <-t.done:
+		return nil
+	case <-time.After(TunnelStopTimeout):
+		return fmt.Errorf("profile %s did not disconnect in time, run repair %s: %v", name, name, t.cmd.Process.Kill())
+	}
+}
+
+// StopTunnels disconnects all profiles, e.g. when the app quits.
+func StopTunnels() {
+	tunnelsMutex.Lock()
+	names := []string{}
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	tunnelsMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := StopTunnel(name); err != nil {
+				log.Print(err)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// GetTunnelStatuses returns the status of the main tunnel followed by the
+// ones of the connected profiles.
+func GetTunnelStatuses() []TunnelStatus {
+	server := GetActiveEndpoint()
+	if server == "" {
+		server = config.AppConfig.ServerAddr
+	}
+	statuses := []TunnelStatus{{
+		State:        GetConnectionState(),
+		Server:       server,
+		Device:       config.AppConfig.DeviceName,
+		Address:      config.AppConfig.CIDR,
+		ReadBytes:    counter.GetReadBytes(),
+		WrittenBytes: counter.GetWrittenBytes(),
+	}}
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	others := []TunnelStatus{}
+	for _, t := range tunnels {
+		t.Lock()
+		others = append(others, t.status)
+		t.Unlock()
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Profile < others[j].Profile })
+	return append(statuses, others...)
+}
+
+// CheckMainConflicts reports whether the main tunnel can be connected
+// alongside the connected profiles.
+func CheckMainConflicts(c config.Config, options IClientOptions) error {
+	return checkConflicts(tunnelSpec{config: c, options: options})
+}
+
+// checkConflicts compares spec with the main tunnel, if connected, and
+// with the connected profiles.
+func checkConflicts(spec tunnelSpec) error {
+	others := []tunnelSpec{}
+	if spec.name != "" && GetConnectionState() != Disconnected {
+		others = append(others, tunnelSpec{config: config.AppConfig, options: ClientOptions})
+	}
+	tunnelsMutex.Lock()
+	for _, t := range tunnels {
+		if t.spec.name != spec.name {
+			others = append(others, t.spec)
+		}
+	}
+	tunnelsMutex.Unlock()
+	conflicts := []string{}
+	for _, other := range others {
+		for _, c := range tunnelConflicts(spec, other) {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %s", other.displayName(), c))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s conflicts with connected tunnels:\n%s", spec.displayName(), strings.Join(conflicts, "\n"))
+	}
+	return nil
+}
+
+func (s tunnelSpec) displayName() string {
+	if s.name == "" {
+		return "main tunnel"
+	}
+	return s.name
+}
+
+// tunnelConflicts returns the reasons why tunnels a and b can't be
+// connected at the same time.
+func tunnelConflicts(a, b tunnelSpec) []string {
+	conflicts := []string{}
+	ao, bo := a.options, b.options
+	hostA, hostB := !ao.UserspaceStack, !bo.UserspaceStack
+
+	if hostA && hostB {
+		if a.config.DeviceName == b.config.DeviceName {
+			conflicts = append(conflicts, fmt.Sprintf("same interface name %s", a.config.DeviceName))
+		}
+		for _, pa := range tunnelPrefixes(a) {
+			for _, pb := range tunnelPrefixes(b) {
+				if pa.Overlaps(pb) {
+					conflicts = append(conflicts, fmt.Sprintf("tunnel addresses %s and %s overlap", pa, pb))
+				}
+			}
+		}
+		includeA, includeB := includedPrefixes(ao), includedPrefixes(bo)
+		switch {
+		case len(includeA) == 0 && len(includeB) == 0:
+			conflicts = append(conflicts, "both route all traffic")
+		case len(includeA) > 0 && len(includeB) > 0:
+			for _, pa := range includeA {
+				for _, pb := range includeB {
+					if pa.Overlaps(pb) {
+						conflicts = append(conflicts, fmt.Sprintf("routes %s and %s overlap", pa, pb))
+					}
+				}
+			}
+		}
+		if ao.KillSwitch || bo.KillSwitch {
+			conflicts = append(conflicts, "the kill switch blocks other tunnels")
+		}
+		if ao.BlockOffTunnelDNS || bo.BlockOffTunnelDNS {
+			conflicts = append(conflicts, "DNS blocking drops the queries of other tunnels")
+		}
+		if appliesDNS(ao) && appliesDNS(bo) {
+			conflicts = append(conflicts, "both configure the system DNS")
+		}
+		if ao.PolicyRouting && bo.PolicyRouting && (ao.RoutingTable == bo.RoutingTable || ao.FwMark == bo.FwMark) {
+			conflicts = append(conflicts, fmt.Sprintf("same policy routing table %d or mark %d", ao.RoutingTable, ao.FwMark))
+		}
+	}
+	if runsResolver(ao) && runsResolver(bo) && ao.ResolverAddr == bo.ResolverAddr {
+		conflicts = append(conflicts, fmt.Sprintf("both run a resolver on %s", ao.ResolverAddr))
+	}
+	if !hostA && !hostB {
+		for _, addr := range []string{ao.SOCKSAddr, ao.HTTPProxyAddr} {
+			if addr != "" && (addr == bo.SOCKSAddr || addr == bo.HTTPProxyAddr) {
+				conflicts = append(conflicts, fmt.Sprintf("both run a proxy on %s", addr))
+			}
+		}
+	}
+	for _, fa := range ao.Forwards {
+		for _, fb := range bo.Forwards {
+			if fa.Protocol == fb.Protocol && fa.Local == fb.Local {
+				conflicts = append(conflicts, fmt.Sprintf("both forward %s %s", fa.Protocol, fa.Local))
+			}
+		}
+	}
+	return conflicts
+}
+
+// tunnelPrefixes returns the subnets of the tunnel addresses.
+func tunnelPrefixes(s tunnelSpec) []netip.Prefix {
+	return parseValid([]string{s.config.CIDR, s.options.CIDRv6})
+}
+
+// includedPrefixes returns the prefixes a split tunnel routes, none for a
+// full tunnel.
+func includedPrefixes(options IClientOptions) []netip.Prefix {
+	return parseValid(MergeRoutes(options).IncludeRoutes)
+}
+
+func runsResolver(options IClientOptions) bool {
+	return options.DNSForwarder || len(options.DomainRoutes) > 0
+}
+
+// appliesDNS reports whether connecting changes the system DNS, see
+// applyDNS. The servers pushed by the server are known from the last
+// connection.
+func appliesDNS(options IClientOptions) bool {
+	return options.ApplyDNS && (runsResolver(options) || len(options.ServerDNS.Servers) > 0)
+}
+
+// prefixLogger logs each line written to it with a prefix.
+type prefixLogger struct {
+	prefix string
+}
+
+func (l *prefixLogger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Print(l.prefix + line)
+	}
+	return len(p), nil
+}
+
+// RunTunnel runs the client of the profile in use until stop is closed,
+// writing its status to w every second. See IsolateProfile.
+func RunTunnel(name string, stop <-chan struct{}, w io.Writer) error {
+	if err := SavePidFile(); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("profile %s is already connected", name)
+		}
+		return err
+	}
+	defer RmPidFile()
+	if IsJournalFileExists() {
+		if err := RepairNetwork(); err != nil {
+			log.Printf("Unable to restore network configuration: %v", err)
+		}
+	}
+
+	var lastErr error
+	var errMutex sync.Mutex
+	errCh := make(chan error, 1)
+	go func() {
+		for err := range errCh {
+			errMutex.Lock()
+			lastErr = err
+			errMutex.Unlock()
+		}
+	}()
+	encoder := json.NewEncoder(w)
+	report := func() {
+		status := GetTunnelStatuses()[0]
+		status.Profile = name
+		errMutex.Lock()
+		if lastErr != nil {
+			status.Error = lastErr.Error()
+		}
+		errMutex.Unlock()
+		if err := encoder.Encode(status); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if err := PrepareTapMAC(); err != nil {
+		return err
+	}
+	go StartClient(config.AppConfig, errCh)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-stop:
+			break loop
+		}
+	}
+	err := StopClient(config.AppConfig)
+	report()
+	return err
+}
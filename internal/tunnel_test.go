@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTunnelConflicts(t *testing.T) {
+	spec := func(name, dev, cidr string, include ...string) tunnelSpec {
+		s := tunnelSpec{name: name, config: DefaultConfig(), options: DefaultOptions}
+		s.config.DeviceName, s.config.CIDR = dev, cidr
+		s.options.IncludeRoutes = include
+		return s
+	}
+	tests := []struct {
+		name   string
+		modify func(a, b *tunnelSpec)
+		// conflicts are parts of the expected reasons, none if empty
+		conflicts []string
+	}{
+		{"disjoint split tunnels", func(a, b *tunnelSpec) {}, nil},
+		{"same interface", func(a, b *tunnelSpec) { b.config.DeviceName = a.config.DeviceName }, []string{"same interface name"}},
+		{"tunnel addresses", func(a, b *tunnelSpec) { b.config.CIDR = "172.20.0.3/24" }, []string{"tunnel addresses"}},
+		{"both full tunnel", func(a, b *tunnelSpec) { a.options.IncludeRoutes, b.options.IncludeRoutes = nil, nil }, []string{"both route all traffic"}},
+		{"one full tunnel", func(a, b *tunnelSpec) { a.options.IncludeRoutes = nil }, nil},
+		{"overlapping routes", func(a, b *tunnelSpec) { b.options.IncludeRoutes = []string{"10.1.0.0/16"} }, []string{"routes 10.0.0.0/8 and 10.1.0.0/16 overlap"}},
+		{"pushed routes overlap", func(a, b *tunnelSpec) { b.options.ServerRoutes.Include = []string{"10.2.0.0/16"} }, []string{"routes 10.0.0.0/8 and 10.2.0.0/16 overlap"}},
+		{"kill switch", func(a, b *tunnelSpec) { b.options.KillSwitch = true }, []string{"kill switch"}},
+		{"dns blocking", func(a, b *tunnelSpec) { a.options.BlockOffTunnelDNS = true }, []string{"DNS blocking"}},
+		{"both apply dns", func(a, b *tunnelSpec) {
+			a.options.ServerDNS.Servers = []string{"10.0.0.1"}
+			b.options.ServerDNS.Servers = []string{"192.168.50.1"}
+		}, []string{"system DNS"}},
+		{"one applies dns", func(a, b *tunnelSpec) { a.options.ServerDNS.Servers = []string{"10.0.0.1"} }, nil},
+		{"policy routing table", func(a, b *tunnelSpec) { a.options.PolicyRouting, b.options.PolicyRouting = true, true }, []string{"policy routing table"}},
+		{"policy routing other table", func(a, b *tunnelSpec) {
+			a.options.PolicyRouting, b.options.PolicyRouting = true, true
+			b.options.RoutingTable, b.options.FwMark = 7875, 0x7875
+		}, nil},
+		{"resolvers", func(a, b *tunnelSpec) { a.options.DNSForwarder, b.options.DNSForwarder = true, true }, []string{"system DNS", "resolver on 127.0.0.1:53"}},
+		{"resolvers on other addresses", func(a, b *tunnelSpec) {
+			a.options.DNSForwarder, b.options.DNSForwarder = true, true
+			a.options.ApplyDNS, b.options.ResolverAddr = false, "127.0.0.2:53"
+		}, nil},
+		{"userspace and host", func(a, b *tunnelSpec) {
+			b.options.UserspaceStack = true
+			b.config.DeviceName, b.config.CIDR = a.config.DeviceName, a.config.CIDR
+			b.options.KillSwitch = true
+		}, nil},
+		{"userspace proxies", func(a, b *tunnelSpec) { a.options.UserspaceStack, b.options.UserspaceStack = true, true }, []string{"proxy on 127.0.0.1:1080", "proxy on 127.0.0.1:8080"}},
+		{"forwards", func(a, b *tunnelSpec) {
+			a.options.Forwards = []Forward{{"tcp", "127.0.0.1:5432", "10.8.0.5:5432"}}
+			b.options.Forwards = []Forward{{"udp", "127.0.0.1:5432", "10.9.0.5:5432"}, {"tcp", "127.0.0.1:5432", "10.9.0.5:5432"}}
+		}, []string{"both forward tcp 127.0.0.1:5432"}},
+	}
+	for _, tt := range tests {
+		a := spec("office", "xtun-a", "172.20.0.2/24", "10.0.0.0/8")
+		b := spec("lab", "xtun-b", "172.21.0.2/24", "192.168.50.0/24")
+		tt.modify(&a, &b)
+		conflicts := tunnelConflicts(a, b)
+		if len(conflicts) != len(tt.conflicts) {
+			t.Errorf("%s: tunnelConflicts = %q, want %q", tt.name, conflicts, tt.conflicts)
+			continue
+		}
+		for i, want := range tt.conflicts {
+			if !strings.Contains(conflicts[i], want) {
+				t.Errorf("%s: conflict %q, want %q", tt.name, conflicts[i], want)
+			}
+		}
+		// Conflicts don't depend on which tunnel connects first
+		if reverse := tunnelConflicts(b, a); len(reverse) != len(conflicts) {
+			t.Errorf("%s: tunnelConflicts(b, a) = %q, want %d conflicts", tt.name, reverse, len(conflicts))
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+var errUserStackUnavailable = errors.New("userspace mode is not available in this build, build with -tags netstack")
+
+// userStack is a TCP/IP stack running in the client process. It takes the
+// place of the tun interface when the client can't create one, and local
+// applications reach the tunnel through the proxies instead of routes.
+type userStack interface {
+	packetDevice
+	// DialContext connects to addr, an ip:port, through the tunnel
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	// ListenTCP accepts connections from the tunnel on addr
+	ListenTCP(addr netip.AddrPort) (net.Listener, error)
+}
+
+// tunnelDialer connects through a userStack, resolving host names with the
+// DNS servers pushed by the server.
+type tunnelDialer struct {
+	stack    userStack
+	resolver *net.Resolver
+}
+
+func newTunnelDialer(stack userStack, dns PushedDNS) *tunnelDialer {
+	d := &tunnelDialer{stack: stack, resolver: net.DefaultResolver}
+	if len(dns.Servers) > 0 {
+		server := net.JoinHostPort(dns.Servers[0], "53")
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return stack.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return d
+}
+
+func (d *tunnelDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.stack.DialContext(ctx, network, addr)
+	}
+	ips, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.stack.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no addresses found for " + host)
+	}
+	return nil, err
+}
+
+// userspaceDevice is the userspace stack along with the proxies exposing
+// it, which are closed with it.
+type userspaceDevice struct {
+	userStack
+	dialer  *tunnelDialer
+	proxies *proxyServer
+}
+
+func (d *userspaceDevice) Close() error {
+	d.proxies.Close()
+	return d.userStack.Close()
+}
+
+// startUserStack creates the userspace stack with the tunnel addresses
+// and starts the SOCKS5 and HTTP proxies.
+func startUserStack(config config.Config) (packetDevice, error) {
+	addrs := []netip.Prefix{}
+	for _, cidr := range []string{config.CIDR, ClientOptions.CIDRv6} {
+		if cidr == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, p)
+	}
+	stack, err := newUserStack(addrs, config.MTU)
+	if err != nil {
+		return nil, err
+	}
+	dialer := newTunnelDialer(stack, ClientOptions.ServerDNS)
+	proxies, err := startProxies(dialer, ClientOptions)
+	if err != nil {
+		stack.Close()
+		return nil, err
+	}
+	log.Println("Userspace network stack started")
+	return &userspaceDevice{userStack: stack, dialer: dialer, proxies: proxies}, nil
+}